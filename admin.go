@@ -0,0 +1,205 @@
+package traefik_authhack
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminSessionsPath is the path, under AdminPath, of the sessions resource
+const adminSessionsPath = "/sessions"
+
+// adminBundlesPath is the path, under AdminPath, of the bundles resource
+const adminBundlesPath = "/bundles"
+
+// adminAuthLinksPath is the path, under AdminPath, of the auth links resource
+const adminAuthLinksPath = "/authlinks"
+
+// adminOneTimeLinksPath is the path, under AdminPath, of the one-time links resource
+const adminOneTimeLinksPath = "/onetimelinks"
+
+// adminMaxBodySize limits the size of request bodies sent to the admin API
+const adminMaxBodySize = 64 << 10
+
+// adminSession is a session as listed by the admin API. It never includes the credentials or the session ID itself,
+// since either would allow the session to be used.
+type adminSession struct {
+	// ID identifies the session for revoking it, see adminSessionID
+	ID        string    `json:"id"`
+	Username  string    `json:"username,omitempty"`
+	Scheme    string    `json:"scheme"`
+	ClientIP  string    `json:"clientIP,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// serveAdmin serves the admin API, which lists and revokes sessions (if UseSessions is enabled), creates bundles (if
+// BundlePath is set) and signs auth links and one-time links (if AuthLinksFile is set):
+//
+//	GET    <AdminPath>/sessions                   lists active sessions
+//	DELETE <AdminPath>/sessions/<id>              revokes a session
+//	DELETE <AdminPath>/sessions?username=<name>   revokes every session of a user
+//	POST   <AdminPath>/bundles                    creates a bundle, see createAdminBundle
+//	POST   <AdminPath>/authlinks                  signs an auth link, see createAdminAuthLink
+//	POST   <AdminPath>/onetimelinks               creates a one-time link, see createAdminOneTimeLink
+func (p *AuthHackPlugin) serveAdmin(responseWriter http.ResponseWriter, request *http.Request) {
+	if len(p.adminAllowedIPs) != 0 && !p.adminAllowedIPs.Contains(p.clientIP(request)) {
+		p.log(Info, "rejecting admin request from '%s': not an allowed IP", p.clientIP(request))
+
+		p.writeAdminError(responseWriter, http.StatusForbidden)
+
+		return
+	}
+
+	if !constantTimeEqual(request.Header.Get(AuthorizationHeader), bearerPrefix+p.config.AdminToken) {
+		p.log(Info, "rejecting admin request from '%s': invalid token", p.clientIP(request))
+
+		responseWriter.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", p.config.Realm))
+		p.writeAdminError(responseWriter, http.StatusUnauthorized)
+
+		return
+	}
+
+	path := strings.TrimPrefix(request.URL.Path, p.config.AdminPath)
+
+	switch {
+	case path == adminBundlesPath && p.bundleCipher != nil:
+		if request.Method != http.MethodPost {
+			responseWriter.Header().Set("Allow", "POST")
+			p.writeAdminError(responseWriter, http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		p.createAdminBundle(responseWriter, request)
+
+	case path == adminAuthLinksPath && p.config.AuthLinksFile != "":
+		if request.Method != http.MethodPost {
+			responseWriter.Header().Set("Allow", "POST")
+			p.writeAdminError(responseWriter, http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		p.createAdminAuthLink(responseWriter, request)
+
+	case path == adminOneTimeLinksPath && p.oneTimeLedger != nil:
+		if request.Method != http.MethodPost {
+			responseWriter.Header().Set("Allow", "POST")
+			p.writeAdminError(responseWriter, http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		p.createAdminOneTimeLink(responseWriter, request)
+
+	case p.sessions == nil:
+		p.writeAdminError(responseWriter, http.StatusNotFound)
+
+	case path == adminSessionsPath:
+		switch request.Method {
+		case http.MethodGet, http.MethodHead:
+			p.listAdminSessions(responseWriter)
+		case http.MethodDelete:
+			username := request.URL.Query().Get("username")
+			if username == "" {
+				p.writeAdminError(responseWriter, http.StatusBadRequest)
+
+				return
+			}
+
+			p.revokeAdminSessions(responseWriter, func(record sessionRecord) bool {
+				recordUsername, _, ok := record.Auth.Decode()
+
+				return ok && recordUsername == username
+			})
+		default:
+			responseWriter.Header().Set("Allow", "GET, HEAD, DELETE")
+			p.writeAdminError(responseWriter, http.StatusMethodNotAllowed)
+		}
+
+	case strings.HasPrefix(path, adminSessionsPath+"/") && len(path) > len(adminSessionsPath)+1:
+		if request.Method != http.MethodDelete {
+			responseWriter.Header().Set("Allow", "DELETE")
+			p.writeAdminError(responseWriter, http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		id := strings.TrimPrefix(path, adminSessionsPath+"/")
+
+		p.revokeAdminSessions(responseWriter, func(record sessionRecord) bool {
+			return constantTimeEqual(adminSessionID(record.ID), id)
+		})
+
+	default:
+		p.writeAdminError(responseWriter, http.StatusNotFound)
+	}
+}
+
+func (p *AuthHackPlugin) listAdminSessions(responseWriter http.ResponseWriter) {
+	records, _ := p.sessions.Snapshot()
+
+	// Most recently used first
+	sessions := make([]adminSession, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+
+		username, _, _ := record.Auth.Decode()
+
+		sessions = append(sessions, adminSession{
+			ID:        adminSessionID(record.ID),
+			Username:  username,
+			Scheme:    record.Auth.Scheme(),
+			ClientIP:  record.Client.IP,
+			UserAgent: record.Client.UserAgent,
+			CreatedAt: record.CreatedAt,
+			LastSeen:  record.LastSeen,
+			ExpiresAt: record.ExpiresAt,
+		})
+	}
+
+	p.writeAdminJSON(responseWriter, http.StatusOK, map[string]any{"sessions": sessions})
+}
+
+func (p *AuthHackPlugin) revokeAdminSessions(responseWriter http.ResponseWriter, match func(record sessionRecord) bool) {
+	revoked := p.sessions.DeleteFunc(match)
+
+	p.log(Info, "revoked %d sessions through the admin API", revoked)
+
+	if revoked == 0 {
+		p.writeAdminError(responseWriter, http.StatusNotFound)
+
+		return
+	}
+
+	p.writeAdminJSON(responseWriter, http.StatusOK, map[string]any{"revoked": revoked})
+}
+
+func (p *AuthHackPlugin) writeAdminError(responseWriter http.ResponseWriter, statusCode int) {
+	p.writeAdminJSON(responseWriter, statusCode, map[string]any{"error": http.StatusText(statusCode)})
+}
+
+func (p *AuthHackPlugin) writeAdminJSON(responseWriter http.ResponseWriter, statusCode int, value any) {
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Header().Set("Cache-Control", "no-store")
+	responseWriter.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(responseWriter).Encode(value); err != nil {
+		p.log(Warning, "encountered error writing admin response: %v", err)
+	}
+}
+
+// adminSessionID derives the ID the admin API lists a session by. The session ID itself is what the cookie holds, so
+// exposing it would allow anyone reading the list to use the session.
+func adminSessionID(sessionID string) string {
+	sum := sha256.Sum256([]byte("traefik-authhack admin session:" + sessionID))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
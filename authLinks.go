@@ -0,0 +1,207 @@
+package traefik_authhack
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errAuthLinkExpired = errors.New("link has expired")
+
+// authLinks maps the IDs of auth links to the credentials they stand for.
+type authLinks map[string]encodedAuthWithoutPrefix
+
+// parseAuthLinksFile parses a file with one '<id> <authorization>' entry per line, ignoring blank lines and '#'
+// comments. The authorization is a complete Authorization header value, e.g. 'Basic <credentials>'.
+func parseAuthLinksFile(contents []byte) (authLinks, error) {
+	links := make(authLinks)
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, authorization, _ := strings.Cut(entry, " ")
+		authorization = strings.TrimSpace(authorization)
+
+		// The ID is the first part of a link, so it can't contain the separator
+		if strings.Contains(id, ".") || authorization == "" {
+			return nil, fmt.Errorf("line %d: expected '<id> <authorization>' with an ID without '.'", line)
+		}
+
+		if _, ok := links[id]; ok {
+			return nil, fmt.Errorf("line %d: duplicate ID '%s'", line, id)
+		}
+
+		links[id] = newEncodedAuthWithoutPrefix(authorization)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
+
+// newAuthLink returns an auth link, '<id>.<expiry>.<signature>', for the ID that expires at the given time.
+func newAuthLink(secret, id string, expiresAt time.Time) string {
+	return signLink(secret, id, strconv.FormatInt(expiresAt.Unix(), 10))
+}
+
+// signLink joins the fields with '.' and appends their signature, an unpadded base64url HMAC-SHA256 of the joined
+// fields.
+func signLink(secret string, fields ...string) string {
+	signed := strings.Join(fields, ".")
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyLink returns the fields of a link created by signLink, once its signature is verified.
+func (p *AuthHackPlugin) verifyLink(link string, fieldCount int) ([]string, error) {
+	i := strings.LastIndexByte(link, '.')
+	if i < 0 {
+		return nil, errors.New("link is malformed")
+	}
+
+	fields := strings.Split(link[:i], ".")
+	if len(fields) != fieldCount || !constantTimeEqual(link, signLink(p.config.AuthLinkSecret, fields...)) {
+		return nil, errors.New("link signature is invalid")
+	}
+
+	return fields, nil
+}
+
+// resolveAuthLink returns the credentials an auth link stands for, once its signature and expiry are verified.
+func (p *AuthHackPlugin) resolveAuthLink(link string) (encodedAuthWithoutPrefix, error) {
+	fields, err := p.verifyLink(link, 2)
+	if err != nil {
+		return "", err
+	}
+
+	auth, _, err := p.resolveLinkCredentials(fields[0], fields[1])
+
+	return auth, err
+}
+
+// resolveLinkCredentials returns the credentials with the ID in AuthLinksFile and when the link to them expires, unless
+// it already has.
+func (p *AuthHackPlugin) resolveLinkCredentials(id, expiry string) (encodedAuthWithoutPrefix, time.Time, error) {
+	expiresAtUnix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return "", time.Time{}, errors.New("link is malformed")
+	}
+
+	expiresAt := time.Unix(expiresAtUnix, 0)
+	if !p.now().Before(expiresAt) {
+		return "", time.Time{}, fmt.Errorf("link '%s': %w", id, errAuthLinkExpired)
+	}
+
+	// Removing the ID from the file revokes every link to it
+	auth, ok := p.getAuthLinks()[id]
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("link '%s' isn't in AuthLinksFile", id)
+	}
+
+	return auth, expiresAt, nil
+}
+
+func (p *AuthHackPlugin) getAuthLinks() authLinks {
+	return p.authLinks.Load().(authLinks)
+}
+
+func (p *AuthHackPlugin) getAndScrubAuthLinkQueryParam(query *requestQueryWrapper) encodedAuthWithoutPrefix {
+	var result encodedAuthWithoutPrefix
+
+	if p.config.AuthLinksFile == "" {
+		return result
+	}
+
+	if link := query.Get(p.config.AuthLinkQueryParam); link != "" {
+		auth, err := p.resolveAuthLink(link)
+		if err != nil {
+			p.log(Info, "ignoring auth link query param ('%s'): %v", p.config.AuthLinkQueryParam, err)
+		} else {
+			result = auth
+
+			p.log(Debug, "found auth link query param ('%s': '%s'), moving to header", p.config.AuthLinkQueryParam, link)
+		}
+
+		query.Del(p.config.AuthLinkQueryParam)
+	}
+
+	return result
+}
+
+// adminAuthLinkRequest is the body of a request to create an auth link or one-time link through the admin API.
+type adminAuthLinkRequest struct {
+	// ID is the ID of an entry in AuthLinksFile
+	ID string `json:"id"`
+	// Lifetime is how long (as a Go duration, e.g. "720h") the link is valid
+	Lifetime string `json:"lifetime"`
+}
+
+// createAdminAuthLink signs a link to an entry in AuthLinksFile, responding with the value of the auth link query
+// param.
+func (p *AuthHackPlugin) createAdminAuthLink(responseWriter http.ResponseWriter, request *http.Request) {
+	id, expiresAt, ok := p.parseAdminLinkRequest(responseWriter, request)
+	if !ok {
+		return
+	}
+
+	p.log(Info, "created auth link for '%s' through the admin API", id)
+
+	p.writeAdminJSON(responseWriter, http.StatusOK, map[string]any{
+		"param":     p.config.AuthLinkQueryParam,
+		"authlink":  newAuthLink(p.config.AuthLinkSecret, id, expiresAt),
+		"expiresAt": expiresAt.UTC(),
+	})
+}
+
+// parseAdminLinkRequest returns the ID and expiry of the link requested, see adminAuthLinkRequest. If the request is
+// invalid, an error is sent and ok is false.
+func (p *AuthHackPlugin) parseAdminLinkRequest(responseWriter http.ResponseWriter, request *http.Request) (id string, expiresAt time.Time, ok bool) {
+	var body adminAuthLinkRequest
+
+	request.Body = http.MaxBytesReader(responseWriter, request.Body, adminMaxBodySize)
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		p.log(Info, "rejecting admin link: body is malformed")
+
+		p.writeAdminError(responseWriter, http.StatusBadRequest)
+
+		return "", time.Time{}, false
+	}
+
+	lifetime, err := time.ParseDuration(body.Lifetime)
+	if err != nil || lifetime <= 0 {
+		p.log(Info, "rejecting admin link: invalid lifetime '%s'", body.Lifetime)
+
+		p.writeAdminError(responseWriter, http.StatusBadRequest)
+
+		return "", time.Time{}, false
+	}
+
+	if _, ok := p.getAuthLinks()[body.ID]; !ok {
+		p.log(Info, "rejecting admin link: '%s' isn't in AuthLinksFile", body.ID)
+
+		p.writeAdminError(responseWriter, http.StatusNotFound)
+
+		return "", time.Time{}, false
+	}
+
+	// Links expire on a whole second
+	return body.ID, time.Unix(p.now().Add(lifetime).Unix(), 0), true
+}
@@ -1,9 +1,15 @@
 package traefik_authhack
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 /*
@@ -14,6 +20,22 @@ TODO:
 
 const AuthorizationHeader = "Authorization"
 
+// Actions for UpstreamUnauthorizedAction
+const (
+	UpstreamUnauthorizedPass  = "pass"
+	UpstreamUnauthorizedLogin = "login"
+	UpstreamUnauthorizedStrip = "strip"
+)
+
+// Actions for QueryAuthDeniedAction
+const (
+	QueryAuthDeniedIgnore = "ignore"
+	QueryAuthDeniedReject = "reject"
+)
+
+// sessionCookieValuePrefix marks cookie values that reference a session rather than holding the auth itself
+const sessionCookieValuePrefix = "sid."
+
 // Config is the configuration for the plugin.
 type Config struct {
 	LogLevel LogLevel `json:",omitempty"`
@@ -21,10 +43,171 @@ type Config struct {
 	UsernameQueryParam      string `json:",omitempty"`
 	PasswordQueryParam      string `json:",omitempty"`
 	AuthorizationQueryParam string `json:",omitempty"`
+	// AccessTokenQueryParam is the query param holding an OAuth 2.0 bearer token (RFC 6750), which is sent downstream
+	// as 'Authorization: Bearer <token>'
+	AccessTokenQueryParam string `json:",omitempty"`
+	// AuthLinkQueryParam is the query param holding an auth link, '<id>.<expiry>.<signature>', which stands for the
+	// credentials with that ID in AuthLinksFile
+	AuthLinkQueryParam string `json:",omitempty"`
+	// AuthLinksFile, when set, is a file with one '<id> <authorization>' entry per line that auth links refer to
+	AuthLinksFile string `json:",omitempty"`
+	// AuthLinkSecret is used to sign auth links. Requires AuthLinksFile.
+	AuthLinkSecret string `json:",omitempty"`
+	// OneTimeLinkQueryParam is the query param holding a one-time link, which stands for credentials in AuthLinksFile
+	// like an auth link but is only accepted once
+	OneTimeLinkQueryParam string `json:",omitempty"`
+	// OneTimeLedgerFile, when set, is a file that used one-time links are recorded in, so that they can't be reused after
+	// a restart
+	OneTimeLedgerFile string `json:",omitempty"`
 
 	CookieName   string `json:",omitempty"`
 	CookieDomain string `json:",omitempty"`
 	CookiePath   string `json:",omitempty"`
+
+	// CookieSecret, when set, is used to encrypt the cookie value so the credentials aren't stored in plain text
+	CookieSecret string `json:",omitempty"`
+	// CookieSecrets is an ordered list of secrets used to encrypt the cookie value. The first seals new cookies and
+	// every secret is tried when opening one, which allows secrets to be rotated without invalidating cookies.
+	CookieSecrets []string `json:",omitempty"`
+	// CookieSecretsFile, when set, is a file with one cookie secret per line. They are tried before CookieSecrets, so
+	// the first line seals new cookies.
+	CookieSecretsFile string `json:",omitempty"`
+
+	// CookieMaxLifetime is how long (as a Go duration, e.g. "720h") a cookie remains valid after the credentials were
+	// provided, regardless of activity. Requires a cookie secret.
+	CookieMaxLifetime string `json:",omitempty"`
+	// CookieIdleTimeout is how long (as a Go duration, e.g. "24h") a cookie remains valid without being used. Cookies
+	// are renewed once half of the timeout has elapsed. Requires a cookie secret.
+	CookieIdleTimeout string `json:",omitempty"`
+
+	// MultiCredentialCookie has the cookie hold a credential per host, so that services sharing the cookie's domain
+	// can each be given their own credentials through the query params
+	MultiCredentialCookie bool `json:",omitempty"`
+	// CredentialPathPrefixes are path prefixes (e.g. "/grafana") that are given their own credential rather than
+	// sharing the one for their host. Requires MultiCredentialCookie.
+	CredentialPathPrefixes []string `json:",omitempty"`
+
+	// UseSessions stores the auth in memory so that the cookie only holds an opaque session ID
+	UseSessions bool `json:",omitempty"`
+	// SessionTTL is how long (as a Go duration, e.g. "24h") a session remains valid without being used
+	SessionTTL string `json:",omitempty"`
+	// SessionMaxCount is the maximum number of sessions to store, the least recently used are evicted past this
+	SessionMaxCount int `json:",omitempty"`
+	// SessionFile, when set, is where sessions are periodically saved so that they survive a restart. The file is
+	// encrypted with the cookie secret, so one is required.
+	SessionFile string `json:",omitempty"`
+	// SessionSnapshotInterval is how often (as a Go duration, e.g. "1m") sessions are saved to the session file
+	SessionSnapshotInterval string `json:",omitempty"`
+
+	// SessionTokenSecret, when set, exchanges credentials verified against UsersFile for short-lived JWTs signed with
+	// this secret, which are stored in the cookie instead of the credentials. Requires UsersFile.
+	SessionTokenSecret string `json:",omitempty"`
+	// SessionTokenLifetime is how long (as a Go duration, e.g. "1h") issued tokens are valid. Tokens are renewed once
+	// half of their lifetime has elapsed.
+	SessionTokenLifetime string `json:",omitempty"`
+	// UpstreamCredentials maps usernames to the Authorization header sent downstream for requests with an issued token,
+	// e.g. 'Basic <credentials>'. Requests from users without an entry are sent without one.
+	UpstreamCredentials map[string]string `json:",omitempty"`
+
+	// UsersFile, when set, is an htpasswd file that credentials are verified against. Requests without valid
+	// credentials are rejected.
+	UsersFile string `json:",omitempty"`
+	// Realm is the realm sent to clients when credentials are rejected
+	Realm string `json:",omitempty"`
+	// VerificationCacheTTL is how long (as a Go duration, e.g. "5m") verified credentials are remembered so that they
+	// aren't verified against the users file on every request. An empty value disables the cache.
+	VerificationCacheTTL string `json:",omitempty"`
+	// VerificationCacheMaxCount is the maximum number of verified credentials to remember
+	VerificationCacheMaxCount int `json:",omitempty"`
+
+	// OtpQueryParam, when set, is the query param holding a TOTP code, which is required along with the credentials of
+	// users that have a TOTP secret in UsersFile. The login page has a field for it too.
+	OtpQueryParam string `json:",omitempty"`
+	// OtpSkew is how many periods before or after the current one TOTP codes are accepted from, to allow for clock
+	// drift
+	OtpSkew int `json:",omitempty"`
+
+	// RateLimitBurst, when positive, is how many attempts to log in with credentials from the query params or login
+	// page a client IP or username can make at once. Further attempts are rejected with HTTP 429 (Too Many Requests).
+	RateLimitBurst int `json:",omitempty"`
+	// RateLimitInterval is how often (as a Go duration, e.g. "10s") another attempt is allowed, up to RateLimitBurst
+	RateLimitInterval string `json:",omitempty"`
+	// LockoutThreshold, when positive, is how many consecutive rejected credentials lock out a client IP or username
+	LockoutThreshold int `json:",omitempty"`
+	// LockoutDuration is how long (as a Go duration, e.g. "1m") a lockout lasts. It doubles with each further rejection.
+	LockoutDuration string `json:",omitempty"`
+	// RateLimitMaxCount is the maximum number of client IPs and usernames to remember attempts for
+	RateLimitMaxCount int `json:",omitempty"`
+
+	// TrustedProxies, when set, are the IP addresses and CIDRs of proxies (e.g. a load balancer or CDN) whose
+	// TrustedProxyHeader is trusted to report the client's IP, for rate limits, AdminAllowedIPs and sessions
+	TrustedProxies []string `json:",omitempty"`
+	// TrustedProxyHeader is the header trusted proxies report the client's IP in, either 'X-Forwarded-For' or
+	// 'Forwarded'
+	TrustedProxyHeader string `json:",omitempty"`
+
+	// QueryAuthAllowedIPs, when set, are the only IP addresses and CIDRs whose credentials from the query params are
+	// used. The cookie is unaffected, so existing logins keep working.
+	QueryAuthAllowedIPs []string `json:",omitempty"`
+	// QueryAuthDeniedIPs, when set, are IP addresses and CIDRs whose credentials from the query params aren't used,
+	// even if they're in QueryAuthAllowedIPs
+	QueryAuthDeniedIPs []string `json:",omitempty"`
+	// QueryAuthDeniedAction is what to do with credentials from the query params of clients that can't use them: scrub
+	// and ignore them ("ignore") or reject the request with 403 (Forbidden) ("reject")
+	QueryAuthDeniedAction string `json:",omitempty"`
+
+	// JWTSecret, when set, is the shared secret that HS256 bearer tokens from the query params or cookie are verified
+	// with
+	JWTSecret string `json:",omitempty"`
+	// JWTKeysFile, when set, is a JWKS or PEM file with the public keys that RS256 and ES256 bearer tokens from the
+	// query params or cookie are verified with
+	JWTKeysFile string `json:",omitempty"`
+	// JWTIssuer, when set, is the required 'iss' claim of bearer tokens
+	JWTIssuer string `json:",omitempty"`
+	// JWTAudience, when set, is an audience the 'aud' claim of bearer tokens must contain
+	JWTAudience string `json:",omitempty"`
+	// JWTClaimHeaders maps claims of validated bearer tokens to the request headers they're sent downstream in, e.g.
+	// 'sub' to 'X-Auth-Request-User'. Client-supplied copies of these headers are always removed.
+	JWTClaimHeaders map[string]string `json:",omitempty"`
+
+	// LoginPath, when set, is the path of a login page served by the plugin. Page loads without credentials are
+	// redirected to it, and once the submitted credentials are accepted the client is redirected back.
+	LoginPath string `json:",omitempty"`
+	// LoginTemplateFile, when set, is an HTML template (see html/template) for the login page
+	LoginTemplateFile string `json:",omitempty"`
+
+	// LogoutPath, when set, is the path of a logout endpoint served by the plugin, which expires the cookie and deletes
+	// its session. With '?all=1', every session of the user is revoked.
+	LogoutPath string `json:",omitempty"`
+	// LogoutRedirectURL is where clients are redirected after logging out
+	LogoutRedirectURL string `json:",omitempty"`
+
+	// AdminPath, when set, is the path of a JSON API for listing and revoking sessions and creating bundles. Requires
+	// UseSessions or BundlePath.
+	AdminPath string `json:",omitempty"`
+	// AdminToken is the bearer token required to use the admin API
+	AdminToken string `json:",omitempty"`
+	// AdminAllowedIPs, when set, are the IP addresses and CIDRs allowed to use the admin API
+	AdminAllowedIPs []string `json:",omitempty"`
+
+	// BundlePath, when set, is the path of links that log the client into several services at once. The links are
+	// created through the admin API and hold credentials for each host, sealed with BundleSecret.
+	BundlePath string `json:",omitempty"`
+	// BundleSecret is used to seal bundles, so they can neither be read nor forged
+	BundleSecret string `json:",omitempty"`
+	// BundleLifetime is how long (as a Go duration, e.g. "24h") bundles remain valid after being created
+	BundleLifetime string `json:",omitempty"`
+	// BundleRedirectURL is where clients are redirected once a bundle's credentials have been stored
+	BundleRedirectURL string `json:",omitempty"`
+
+	// UpstreamUnauthorizedAction is what to do, besides expiring the cookie, when the downstream service responds 401
+	// (Unauthorized) to credentials from the cookie: pass the response through ("pass"), redirect to the login page
+	// ("login") or pass it through without the WWW-Authenticate header ("strip")
+	UpstreamUnauthorizedAction string `json:",omitempty"`
+
+	// FileWatchInterval is how often (as a Go duration, e.g. "10s") files such as UsersFile and CookieSecretsFile are
+	// checked for changes. An empty value disables reloading.
+	FileWatchInterval string `json:",omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
@@ -35,11 +218,140 @@ func CreateConfig() *Config {
 		UsernameQueryParam:      "username",
 		PasswordQueryParam:      "password",
 		AuthorizationQueryParam: "authorization",
+		AccessTokenQueryParam:   "",
+		AuthLinkQueryParam:      "authlink",
+		AuthLinksFile:           "",
+		AuthLinkSecret:          "",
+		OneTimeLinkQueryParam:   "onetime",
+		OneTimeLedgerFile:       "",
 
 		CookieName:   "traefik-authhack",
 		CookieDomain: "",
 		CookiePath:   "/",
+
+		CookieSecret:      "",
+		CookieSecrets:     nil,
+		CookieSecretsFile: "",
+
+		CookieMaxLifetime: "",
+		CookieIdleTimeout: "",
+
+		MultiCredentialCookie:  false,
+		CredentialPathPrefixes: nil,
+
+		UseSessions:     false,
+		SessionTTL:      "24h",
+		SessionMaxCount: 10000,
+
+		SessionFile:             "",
+		SessionSnapshotInterval: "1m",
+
+		SessionTokenSecret:   "",
+		SessionTokenLifetime: "1h",
+		UpstreamCredentials:  nil,
+
+		UsersFile: "",
+		Realm:     "traefik",
+
+		VerificationCacheTTL:      "5m",
+		VerificationCacheMaxCount: 1000,
+
+		OtpQueryParam: "",
+		OtpSkew:       1,
+
+		RateLimitBurst:    0,
+		RateLimitInterval: "10s",
+		LockoutThreshold:  0,
+		LockoutDuration:   "1m",
+		RateLimitMaxCount: 10000,
+
+		TrustedProxies:     nil,
+		TrustedProxyHeader: XForwardedForHeader,
+
+		QueryAuthAllowedIPs:   nil,
+		QueryAuthDeniedIPs:    nil,
+		QueryAuthDeniedAction: QueryAuthDeniedIgnore,
+
+		JWTSecret:   "",
+		JWTKeysFile: "",
+		JWTIssuer:   "",
+		JWTAudience: "",
+
+		JWTClaimHeaders: nil,
+
+		LoginPath:         "",
+		LoginTemplateFile: "",
+
+		LogoutPath:        "",
+		LogoutRedirectURL: "/",
+
+		AdminPath:       "",
+		AdminToken:      "",
+		AdminAllowedIPs: nil,
+
+		BundlePath:        "",
+		BundleSecret:      "",
+		BundleLifetime:    "24h",
+		BundleRedirectURL: "/",
+
+		UpstreamUnauthorizedAction: UpstreamUnauthorizedPass,
+
+		FileWatchInterval: "10s",
+	}
+}
+
+// cookieSecrets returns the configured cookie secrets in the order they should be tried. CookieSecret is tried
+// after CookieSecrets so that moving it into the list doesn't change which secret seals new cookies.
+func (c *Config) cookieSecrets() []string {
+	secrets := make([]string, 0, len(c.CookieSecrets)+1)
+	secrets = append(secrets, c.CookieSecrets...)
+
+	if c.CookieSecret != "" {
+		for _, secret := range c.CookieSecrets {
+			if secret == c.CookieSecret {
+				return secrets
+			}
+		}
+
+		secrets = append(secrets, c.CookieSecret)
+	}
+
+	return secrets
+}
+
+// parseOptionalDuration parses a duration config value, where an empty value disables the corresponding feature.
+func parseOptionalDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s '%s': %w", name, value, err)
+	}
+
+	if duration <= 0 {
+		return 0, fmt.Errorf("invalid %s '%s': must be positive", name, value)
+	}
+
+	return duration, nil
+}
+
+// parseCookieSecretsFile parses a file with one secret per line, ignoring blank lines and '#' comments.
+func parseCookieSecretsFile(contents []byte) []string {
+	var secrets []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		secrets = append(secrets, line)
 	}
+
+	return secrets
 }
 
 func (c *Config) log(level LogLevel, name, format string, args ...any) {
@@ -53,153 +365,1423 @@ type AuthHackPlugin struct {
 	next   http.Handler
 	config *Config
 	name   string
+
+	// cookieCipher holds a *cookieCipher, which is nil when no cookie secret is configured. It's replaced when the
+	// cookie secrets file changes.
+	cookieCipher atomic.Value
+
+	// cookieMaxLifetime and cookieIdleTimeout are zero when disabled
+	cookieMaxLifetime time.Duration
+	cookieIdleTimeout time.Duration
+
+	// sessions is nil when sessions are disabled
+	sessions *sessionStore
+
+	// sessionTokens is nil when tokens aren't issued
+	sessionTokens       *sessionTokens
+	upstreamCredentials map[string]encodedAuthWithoutPrefix
+
+	// users holds a *htpasswd, which is nil when credentials aren't verified. It's replaced when the users file
+	// changes.
+	users atomic.Value
+	// verificationCache is nil when disabled
+	verificationCache *verificationCache
+	// totpVerifier is nil unless OtpQueryParam is set
+	totpVerifier *totpVerifier
+
+	// rateLimiter is nil unless RateLimitBurst or LockoutThreshold is set
+	rateLimiter *rateLimiter
+
+	clientIPResolver clientIPResolver
+
+	// queryAuthAllowedIPs is empty when any IP not in queryAuthDeniedIPs may use credentials from the query params
+	queryAuthAllowedIPs ipList
+	queryAuthDeniedIPs  ipList
+
+	// jwtValidator is nil when bearer tokens aren't validated
+	jwtValidator *jwtValidator
+
+	// adminAllowedIPs is empty when any IP may use the admin API
+	adminAllowedIPs ipList
+
+	// bundleCipher is nil unless BundlePath is set
+	bundleCipher   *cookieCipher
+	bundleLifetime time.Duration
+
+	// authLinks holds the authLinks from AuthLinksFile. It's replaced when the file changes.
+	authLinks atomic.Value
+	// oneTimeLedger is nil when one-time links are disabled
+	oneTimeLedger *oneTimeLedger
+
+	// loginTemplate holds the *template.Template for the login page. It's replaced when the template file changes.
+	loginTemplate atomic.Value
+
+	now func() time.Time
 }
 
 // New creates a new plugin.
-//
-//goland:noinspection GoUnusedParameter (required by Traefik)
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
 	config.log(Info, name, "initializing")
 
-	return &AuthHackPlugin{
+	plugin := &AuthHackPlugin{
 		config: config,
 		next:   next,
 		name:   name,
-	}, nil
-}
+		now:    time.Now,
+	}
 
-func (p *AuthHackPlugin) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
-	p.log(Debug, "serving request '%s' ('%s')", request.URL, request.RequestURI)
+	var err error
 
-	hasAuthHeader := p.hasAuthHeader(request)
+	plugin.cookieMaxLifetime, err = parseOptionalDuration("CookieMaxLifetime", config.CookieMaxLifetime)
+	if err != nil {
+		return nil, err
+	}
 
-	// Even if we have an auth header, invoke the other handlers so they can scrub the request
-	queryParamsAuthWithoutPrefix := p.getAndScrubAuthQueryParams(request)
-	cookieAuthWithoutPrefix := p.getAndScrubAuthCookie(request)
+	plugin.cookieIdleTimeout, err = parseOptionalDuration("CookieIdleTimeout", config.CookieIdleTimeout)
+	if err != nil {
+		return nil, err
+	}
 
-	if hasAuthHeader {
-		// The request already has an auth header, prefer using that before anything from this plugin
+	fileWatchInterval, err := parseOptionalDuration("FileWatchInterval", config.FileWatchInterval)
+	if err != nil {
+		return nil, err
+	}
 
-		p.log(Debug, "found authorization header, proxying request")
+	var watchers []*fileWatcher
 
-		p.next.ServeHTTP(responseWriter, request)
+	plugin.cookieCipher.Store((*cookieCipher)(nil))
+	plugin.users.Store((*htpasswd)(nil))
 
-		return
+	if config.CookieSecretsFile != "" {
+		watcher := newFileWatcher(config.CookieSecretsFile, func(contents []byte) error {
+			cookieCipher, err := newCookieCipher(append(parseCookieSecretsFile(contents), config.cookieSecrets()...), config.CookieName)
+			if err != nil {
+				return err
+			}
+
+			plugin.cookieCipher.Store(cookieCipher)
+
+			return nil
+		}, plugin.log)
+
+		if err := watcher.Load(); err != nil {
+			return nil, err
+		}
+
+		watchers = append(watchers, watcher)
+	} else if cookieSecrets := config.cookieSecrets(); len(cookieSecrets) != 0 {
+		cookieCipher, err := newCookieCipher(cookieSecrets, config.CookieName)
+		if err != nil {
+			return nil, err
+		}
+
+		plugin.cookieCipher.Store(cookieCipher)
 	}
 
-	if !queryParamsAuthWithoutPrefix.IsEmpty() && queryParamsAuthWithoutPrefix != cookieAuthWithoutPrefix {
-		// The request had auth specified by the query params that differs from the cookie (or the cookie isn't set),
-		// request that the client sets an auth cookie for subsequent requests and redirect them to the URL without
-		// query params set.
+	if plugin.getCookieCipher() == nil {
+		if plugin.cookieMaxLifetime != 0 || plugin.cookieIdleTimeout != 0 {
+			return nil, errors.New("CookieMaxLifetime and CookieIdleTimeout require a cookie secret")
+		}
 
-		p.log(Debug, "cookie is unset or differs from provided auth, requesting redirect and set cookie")
+		if !config.UseSessions {
+			config.log(Warning, name, "no cookie secret configured, credentials will be stored in the cookie unencrypted")
+		}
+	}
 
-		// Set the cookie
-		cookie := &http.Cookie{
-			Name:     p.config.CookieName,
-			Value:    queryParamsAuthWithoutPrefix.String(),
-			Domain:   p.config.CookieDomain,
-			Path:     p.config.CookiePath,
-			Secure:   true, // HTTPS only
-			HttpOnly: true, // Unavailable to JavaScript
-			SameSite: http.SameSiteStrictMode,
+	if len(config.CredentialPathPrefixes) != 0 {
+		if !config.MultiCredentialCookie {
+			return nil, errors.New("CredentialPathPrefixes requires MultiCredentialCookie")
 		}
-		responseWriter.Header().Set("Set-Cookie", cookie.String())
 
-		// Request a redirect. HTTP 307 (Temporary Redirect) preserves the method and body.
-		responseWriter.Header().Set("Location", request.RequestURI)
-		responseWriter.WriteHeader(307)
+		for _, prefix := range config.CredentialPathPrefixes {
+			if !strings.HasPrefix(prefix, "/") || prefix == "/" {
+				return nil, fmt.Errorf("CredentialPathPrefixes entry '%s' must start with '/' and not be the root", prefix)
+			}
+		}
+	}
+
+	if config.UseSessions {
+		sessionTTL, err := time.ParseDuration(config.SessionTTL)
+		if err != nil || sessionTTL <= 0 {
+			return nil, fmt.Errorf("invalid SessionTTL '%s'", config.SessionTTL)
+		}
+
+		if config.SessionMaxCount <= 0 {
+			return nil, fmt.Errorf("invalid SessionMaxCount '%d': must be positive", config.SessionMaxCount)
+		}
+
+		plugin.sessions = newSessionStore(sessionTTL, config.SessionMaxCount, func() time.Time { return plugin.now() })
+
+		if config.SessionFile != "" {
+			if plugin.getCookieCipher() == nil {
+				return nil, errors.New("SessionFile requires a cookie secret")
+			}
 
-		_, err := responseWriter.Write(nil)
+			snapshotInterval, err := time.ParseDuration(config.SessionSnapshotInterval)
+			if err != nil || snapshotInterval <= 0 {
+				return nil, fmt.Errorf("invalid SessionSnapshotInterval '%s'", config.SessionSnapshotInterval)
+			}
+
+			persister := newSessionPersister(config.SessionFile, plugin.sessions, plugin.getCookieCipher, plugin.log)
+			persister.Load()
+
+			go persister.Run(ctx, snapshotInterval)
+		}
+	} else if config.SessionFile != "" {
+		return nil, errors.New("SessionFile requires UseSessions")
+	}
+
+	if config.UsersFile != "" {
+		verificationCacheTTL, err := parseOptionalDuration("VerificationCacheTTL", config.VerificationCacheTTL)
 		if err != nil {
-			p.log(Warning, "encountered error sending redirect response: %v", err)
+			return nil, err
 		}
 
-		return
+		if verificationCacheTTL != 0 {
+			if config.VerificationCacheMaxCount <= 0 {
+				return nil, fmt.Errorf("invalid VerificationCacheMaxCount '%d': must be positive", config.VerificationCacheMaxCount)
+			}
+
+			plugin.verificationCache, err = newVerificationCache(verificationCacheTTL, config.VerificationCacheMaxCount, func() time.Time { return plugin.now() })
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		watcher := newFileWatcher(config.UsersFile, func(contents []byte) error {
+			users, err := parseHtpasswd(bytes.NewReader(contents))
+			if err != nil {
+				return err
+			}
+
+			plugin.setUsers(users)
+
+			return nil
+		}, plugin.log)
+
+		if err := watcher.Load(); err != nil {
+			return nil, err
+		}
+
+		watchers = append(watchers, watcher)
 	}
 
-	if !cookieAuthWithoutPrefix.IsEmpty() {
-		// Add auth from the cookie before finally sending the request downstream
+	if config.OtpQueryParam != "" {
+		if config.UsersFile == "" {
+			return nil, errors.New("OtpQueryParam requires UsersFile")
+		}
 
-		p.log(Debug, "found cookie, moving to authorization header and proxying request")
+		// A plain cookie holds the credentials as-is, so one could be forged to skip the second factor
+		if plugin.getCookieCipher() == nil && !config.UseSessions && config.SessionTokenSecret == "" {
+			return nil, errors.New("OtpQueryParam requires a cookie secret, UseSessions or SessionTokenSecret")
+		}
+
+		if config.OtpSkew < 0 {
+			return nil, fmt.Errorf("invalid OtpSkew '%d': must not be negative", config.OtpSkew)
+		}
 
-		request.Header.Add(AuthorizationHeader, cookieAuthWithoutPrefix.WithPrefix().String())
+		plugin.totpVerifier = newTOTPVerifier(config.OtpSkew, func() time.Time { return plugin.now() })
 	}
 
-	p.next.ServeHTTP(responseWriter, request)
-}
+	if config.RateLimitBurst < 0 {
+		return nil, fmt.Errorf("invalid RateLimitBurst '%d': must not be negative", config.RateLimitBurst)
+	}
 
-func (p *AuthHackPlugin) log(level LogLevel, format string, args ...any) {
-	p.config.log(level, p.name, format, args...)
-}
+	if config.LockoutThreshold < 0 {
+		return nil, fmt.Errorf("invalid LockoutThreshold '%d': must not be negative", config.LockoutThreshold)
+	}
 
-func (p *AuthHackPlugin) hasAuthHeader(request *http.Request) bool {
-	return request.Header.Get(AuthorizationHeader) != ""
-}
+	if config.RateLimitBurst > 0 || config.LockoutThreshold > 0 {
+		var rateLimitInterval, lockoutDuration time.Duration
 
-func (p *AuthHackPlugin) getAndScrubAuthQueryParams(request *http.Request) encodedAuthWithoutPrefix {
-	query := newQueryWrapper(request)
+		if config.RateLimitBurst > 0 {
+			rateLimitInterval, err = time.ParseDuration(config.RateLimitInterval)
+			if err != nil || rateLimitInterval <= 0 {
+				return nil, fmt.Errorf("invalid RateLimitInterval '%s'", config.RateLimitInterval)
+			}
+		}
 
-	result := p.getAndScrubAuthQueryParam(query)
+		if config.LockoutThreshold > 0 {
+			lockoutDuration, err = time.ParseDuration(config.LockoutDuration)
+			if err != nil || lockoutDuration <= 0 {
+				return nil, fmt.Errorf("invalid LockoutDuration '%s'", config.LockoutDuration)
+			}
+		}
 
-	// Even if we already have a result, continue to run the remaining handlers so they all get a chance to sanitize the request
-	userAndPassResult := p.getAndScrubUserPassQueryParams(query)
-	if result.IsEmpty() {
-		result = userAndPassResult
-	} else if result != userAndPassResult {
-		p.log(Info, "found both authorization query param and username / password query params that are mismatched, using authorization query param")
+		if config.RateLimitMaxCount <= 0 {
+			return nil, fmt.Errorf("invalid RateLimitMaxCount '%d': must be positive", config.RateLimitMaxCount)
+		}
+
+		plugin.rateLimiter = newRateLimiter(config.RateLimitBurst, rateLimitInterval, config.LockoutThreshold, lockoutDuration, config.RateLimitMaxCount, func() time.Time { return plugin.now() })
 	}
 
-	query.Apply()
+	plugin.clientIPResolver.trustedProxies, err = parseIPList("TrustedProxies", config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
 
-	return result
-}
+	switch http.CanonicalHeaderKey(config.TrustedProxyHeader) {
+	case XForwardedForHeader:
+		plugin.clientIPResolver.header = XForwardedForHeader
+	case ForwardedHeader:
+		plugin.clientIPResolver.header = ForwardedHeader
+	default:
+		return nil, fmt.Errorf("invalid TrustedProxyHeader '%s': expected '%s' or '%s'", config.TrustedProxyHeader, XForwardedForHeader, ForwardedHeader)
+	}
 
-func (p *AuthHackPlugin) getAndScrubAuthQueryParam(query *requestQueryWrapper) encodedAuthWithoutPrefix {
-	var result encodedAuthWithoutPrefix
+	if config.SessionTokenSecret != "" {
+		if config.UsersFile == "" {
+			return nil, errors.New("SessionTokenSecret requires UsersFile")
+		}
 
-	if authorization := query.Get(p.config.AuthorizationQueryParam); authorization != "" {
-		result = newEncodedAuthWithoutPrefix(authorization)
+		if config.UseSessions {
+			return nil, errors.New("SessionTokenSecret can't be combined with UseSessions")
+		}
 
-		p.log(Debug, "found authorization query param ('%s': '%s'), moving to header", p.config.AuthorizationQueryParam, result)
+		sessionTokenLifetime, err := time.ParseDuration(config.SessionTokenLifetime)
+		if err != nil || sessionTokenLifetime <= 0 {
+			return nil, fmt.Errorf("invalid SessionTokenLifetime '%s'", config.SessionTokenLifetime)
+		}
 
-		query.Del(p.config.AuthorizationQueryParam)
+		plugin.sessionTokens = newSessionTokens(config.SessionTokenSecret, sessionTokenLifetime, func() time.Time { return plugin.now() })
+
+		plugin.upstreamCredentials = make(map[string]encodedAuthWithoutPrefix, len(config.UpstreamCredentials))
+		for username, auth := range config.UpstreamCredentials {
+			plugin.upstreamCredentials[username] = newEncodedAuthWithoutPrefix(auth)
+		}
+	} else if len(config.UpstreamCredentials) != 0 {
+		return nil, errors.New("UpstreamCredentials requires SessionTokenSecret")
 	}
 
-	return result
-}
+	if config.AuthLinksFile != "" {
+		if config.AuthLinkSecret == "" {
+			return nil, errors.New("AuthLinksFile requires AuthLinkSecret")
+		}
 
-func (p *AuthHackPlugin) getAndScrubUserPassQueryParams(query *requestQueryWrapper) encodedAuthWithoutPrefix {
-	var result encodedAuthWithoutPrefix
+		if config.AuthLinkQueryParam == "" {
+			return nil, errors.New("AuthLinksFile requires AuthLinkQueryParam")
+		}
 
-	if username := query.Get(p.config.UsernameQueryParam); username != "" {
-		// Allow for not specifying a password
-		password := query.Get(p.config.PasswordQueryParam)
+		watcher := newFileWatcher(config.AuthLinksFile, func(contents []byte) error {
+			links, err := parseAuthLinksFile(contents)
+			if err != nil {
+				return err
+			}
 
-		result = encodeAuthWithoutPrefix(username, password)
+			plugin.authLinks.Store(links)
 
-		p.log(Debug, "found username and password query params ('%s': '%s' / '%s': '%s'), moving to header ('%s')", p.config.UsernameQueryParam, username, p.config.PasswordQueryParam, password, result.String())
+			return nil
+		}, plugin.log)
 
-		query.Del(p.config.UsernameQueryParam)
-		query.Del(p.config.PasswordQueryParam)
+		if err := watcher.Load(); err != nil {
+			return nil, err
+		}
+
+		watchers = append(watchers, watcher)
+
+		if config.OneTimeLinkQueryParam != "" {
+			if config.OneTimeLinkQueryParam == config.AuthLinkQueryParam {
+				return nil, errors.New("OneTimeLinkQueryParam and AuthLinkQueryParam must differ")
+			}
+
+			plugin.oneTimeLedger = newOneTimeLedger(config.OneTimeLedgerFile, func() time.Time { return plugin.now() })
+
+			if config.OneTimeLedgerFile != "" {
+				if err := plugin.oneTimeLedger.Load(); err != nil {
+					return nil, err
+				}
+			}
+		} else if config.OneTimeLedgerFile != "" {
+			return nil, errors.New("OneTimeLedgerFile requires OneTimeLinkQueryParam")
+		}
+	} else if config.AuthLinkSecret != "" {
+		return nil, errors.New("AuthLinkSecret requires AuthLinksFile")
+	} else if config.OneTimeLedgerFile != "" {
+		return nil, errors.New("OneTimeLedgerFile requires AuthLinksFile")
 	}
 
-	return result
-}
+	if config.JWTSecret != "" || config.JWTKeysFile != "" {
+		plugin.jwtValidator = newJWTValidator(config.JWTSecret, config.JWTIssuer, config.JWTAudience, func() time.Time { return plugin.now() })
 
-func (p *AuthHackPlugin) getAndScrubAuthCookie(request *http.Request) encodedAuthWithoutPrefix {
-	cookies := request.Cookies()
-	for _, cookie := range cookies {
-		if cookie.Name == p.config.CookieName {
-			p.log(Debug, "found cookie ('%s': '%s'), removing from request", cookie.Name, cookie.Value)
+		if config.JWTKeysFile != "" {
+			watcher := newFileWatcher(config.JWTKeysFile, func(contents []byte) error {
+				keys, err := parseJWTKeySet(contents)
+				if err != nil {
+					return err
+				}
 
-			p.removeCookie(request, cookies, cookie)
+				plugin.jwtValidator.setKeys(keys)
+
+				return nil
+			}, plugin.log)
+
+			if err := watcher.Load(); err != nil {
+				return nil, err
+			}
+
+			watchers = append(watchers, watcher)
+		}
+	} else if config.JWTIssuer != "" || config.JWTAudience != "" {
+		return nil, errors.New("JWTIssuer and JWTAudience require JWTSecret or JWTKeysFile")
+	} else if len(config.JWTClaimHeaders) != 0 && config.SessionTokenSecret == "" {
+		return nil, errors.New("JWTClaimHeaders requires JWTSecret, JWTKeysFile or SessionTokenSecret")
+	}
+
+	for claim, header := range config.JWTClaimHeaders {
+		if claim == "" || header == "" || isReservedClaimHeader(header) {
+			return nil, fmt.Errorf("invalid JWTClaimHeaders mapping '%s': '%s'", claim, header)
+		}
+	}
+
+	if config.LoginPath != "" {
+		if !strings.HasPrefix(config.LoginPath, "/") {
+			return nil, fmt.Errorf("invalid LoginPath '%s': must start with '/'", config.LoginPath)
+		}
+
+		if config.LoginTemplateFile != "" {
+			watcher := newFileWatcher(config.LoginTemplateFile, func(contents []byte) error {
+				loginTemplate, err := parseLoginTemplate(string(contents))
+				if err != nil {
+					return err
+				}
+
+				plugin.loginTemplate.Store(loginTemplate)
+
+				return nil
+			}, plugin.log)
+
+			if err := watcher.Load(); err != nil {
+				return nil, err
+			}
+
+			watchers = append(watchers, watcher)
+		} else {
+			loginTemplate, err := parseLoginTemplate(defaultLoginTemplate)
+			if err != nil {
+				return nil, err
+			}
+
+			plugin.loginTemplate.Store(loginTemplate)
+		}
+	} else if config.LoginTemplateFile != "" {
+		return nil, errors.New("LoginTemplateFile requires LoginPath")
+	}
+
+	if config.LogoutPath != "" {
+		if !strings.HasPrefix(config.LogoutPath, "/") {
+			return nil, fmt.Errorf("invalid LogoutPath '%s': must start with '/'", config.LogoutPath)
+		}
+
+		if config.LogoutRedirectURL == "" {
+			return nil, errors.New("LogoutPath requires LogoutRedirectURL")
+		}
+	}
+
+	if config.AdminPath != "" {
+		if !strings.HasPrefix(config.AdminPath, "/") {
+			return nil, fmt.Errorf("invalid AdminPath '%s': must start with '/'", config.AdminPath)
+		}
+
+		if !config.UseSessions && config.BundlePath == "" && config.AuthLinksFile == "" {
+			return nil, errors.New("AdminPath requires UseSessions, BundlePath or AuthLinksFile")
+		}
+
+		if config.AdminToken == "" {
+			return nil, errors.New("AdminPath requires AdminToken")
+		}
+
+		plugin.adminAllowedIPs, err = parseIPList("AdminAllowedIPs", config.AdminAllowedIPs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.BundlePath != "" {
+		if !strings.HasPrefix(config.BundlePath, "/") {
+			return nil, fmt.Errorf("invalid BundlePath '%s': must start with '/'", config.BundlePath)
+		}
+
+		if config.BundleSecret == "" {
+			return nil, errors.New("BundlePath requires BundleSecret")
+		}
+
+		// Bundles are only created through the admin API
+		if config.AdminPath == "" {
+			return nil, errors.New("BundlePath requires AdminPath")
+		}
+
+		if config.BundleRedirectURL == "" {
+			return nil, errors.New("BundlePath requires BundleRedirectURL")
+		}
+
+		plugin.bundleLifetime, err = time.ParseDuration(config.BundleLifetime)
+		if err != nil || plugin.bundleLifetime <= 0 {
+			return nil, fmt.Errorf("invalid BundleLifetime '%s'", config.BundleLifetime)
+		}
+
+		plugin.bundleCipher, err = newCookieCipher([]string{config.BundleSecret}, bundleAdditionalData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	plugin.queryAuthAllowedIPs, err = parseIPList("QueryAuthAllowedIPs", config.QueryAuthAllowedIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	plugin.queryAuthDeniedIPs, err = parseIPList("QueryAuthDeniedIPs", config.QueryAuthDeniedIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.QueryAuthDeniedAction {
+	case QueryAuthDeniedIgnore, QueryAuthDeniedReject:
+	default:
+		return nil, fmt.Errorf("invalid QueryAuthDeniedAction '%s'", config.QueryAuthDeniedAction)
+	}
+
+	switch config.UpstreamUnauthorizedAction {
+	case UpstreamUnauthorizedPass, UpstreamUnauthorizedStrip:
+	case UpstreamUnauthorizedLogin:
+		if config.LoginPath == "" {
+			return nil, errors.New("UpstreamUnauthorizedAction 'login' requires LoginPath")
+		}
+	default:
+		return nil, fmt.Errorf("invalid UpstreamUnauthorizedAction '%s'", config.UpstreamUnauthorizedAction)
+	}
+
+	if fileWatchInterval != 0 {
+		for _, watcher := range watchers {
+			go watcher.Run(ctx, fileWatchInterval)
+		}
+	}
+
+	return plugin, nil
+}
+
+func (p *AuthHackPlugin) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	p.log(Debug, "serving request '%s' ('%s')", request.URL, request.RequestURI)
+
+	hasAuthHeader := p.hasAuthHeader(request)
+
+	// Claim headers are only ever set by this plugin, otherwise clients could spoof them
+	p.scrubClaimHeaders(request)
+
+	if p.config.LoginPath != "" && request.URL.Path == p.config.LoginPath {
+		p.serveLogin(responseWriter, request)
+
+		return
+	}
+
+	if p.config.AdminPath != "" && (request.URL.Path == p.config.AdminPath || strings.HasPrefix(request.URL.Path, p.config.AdminPath+"/")) {
+		p.serveAdmin(responseWriter, request)
+
+		return
+	}
+
+	if p.config.LogoutPath != "" && request.URL.Path == p.config.LogoutPath {
+		p.serveLogout(responseWriter, request)
+
+		return
+	}
+
+	if p.config.BundlePath != "" && request.URL.Path == p.config.BundlePath {
+		p.serveBundle(responseWriter, request)
+
+		return
+	}
+
+	// Credentials from the query params are always scrubbed, but only used if the client is allowed to
+	queryAuthAllowed := p.isQueryAuthAllowed(request)
+	if !queryAuthAllowed && p.config.QueryAuthDeniedAction == QueryAuthDeniedReject && p.hasAuthQueryParams(request) {
+		p.log(Info, "rejecting credentials from query params from '%s': not an allowed IP", p.clientIP(request))
+
+		http.Error(responseWriter, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+		return
+	}
+
+	// One-time links are used up even if the request has other credentials, so they can't be replayed later
+	oneTimeLinkAuthWithoutPrefix, err := p.getAndScrubOneTimeLinkQueryParam(request, queryAuthAllowed)
+	if err != nil {
+		if isOneTimeLinkGone(err) {
+			p.oneTimeLinkGone(responseWriter)
+		} else {
+			// Handing out the credentials would allow the link to be reused after a restart
+			http.Error(responseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	// Even if we have an auth header, invoke the other handlers so they can scrub the request
+	queryParamsAuthWithoutPrefix, queryParamsOtp, queryParamsFromLink := p.getAndScrubAuthQueryParams(request)
+	if !queryAuthAllowed && !queryParamsAuthWithoutPrefix.IsEmpty() {
+		p.log(Info, "ignoring credentials from query params from '%s': not an allowed IP", p.clientIP(request))
+
+		queryParamsAuthWithoutPrefix = ""
+	}
+	if queryParamsAuthWithoutPrefix.IsEmpty() && !oneTimeLinkAuthWithoutPrefix.IsEmpty() {
+		queryParamsAuthWithoutPrefix = oneTimeLinkAuthWithoutPrefix
+		queryParamsFromLink = true
+	}
+	cookiePayload, cookieStale := p.getAndScrubAuthCookie(request)
+	cookieScope := p.cookieScope(request.Host, request.URL.Path)
+	cookiePayload, cookieEntries := p.selectCookieEntry(cookiePayload, cookieScope)
+	cookieAuthWithoutPrefix, cookieTokenClaims := p.resolveCookieAuth(cookiePayload)
+
+	if hasAuthHeader {
+		// The request already has an auth header, prefer using that before anything from this plugin
+
+		headerAuthWithoutPrefix := newEncodedAuthWithoutPrefix(request.Header.Get(AuthorizationHeader))
+
+		claims, err := p.validateToken(headerAuthWithoutPrefix)
+		if err != nil {
+			p.log(Info, "authorization header has an invalid token, rejecting request: %v", err)
+
+			p.unauthorized(responseWriter)
+
+			return
+		}
+
+		// Headers are sent with every request, so only lockouts apply to them, otherwise they'd bypass them
+		if wait := p.rateLimitWait(request, headerAuthWithoutPrefix, false); wait > 0 {
+			p.log(Info, "client or user is locked out, rejecting request")
+
+			p.tooManyRequests(responseWriter, wait)
+
+			return
+		}
+
+		if !p.verifyAuth(headerAuthWithoutPrefix) {
+			p.log(Info, "authorization header has invalid credentials, rejecting request")
+
+			p.recordAuthFailure(request, headerAuthWithoutPrefix)
+			p.unauthorized(responseWriter)
+
+			return
+		}
+
+		// A header can't carry a TOTP code, so it would otherwise bypass the second factor
+		if !p.verifyOtp(headerAuthWithoutPrefix, "") {
+			p.log(Info, "authorization header is for a user with a TOTP secret, rejecting request")
+
+			p.unauthorized(responseWriter)
+
+			return
+		}
+
+		p.setClaimHeaders(request, claims)
+
+		p.log(Debug, "found authorization header, proxying request")
+
+		p.next.ServeHTTP(responseWriter, request)
+
+		return
+	}
+
+	if !queryParamsAuthWithoutPrefix.IsEmpty() && queryParamsAuthWithoutPrefix != cookieAuthWithoutPrefix {
+		// The request had auth specified by the query params that differs from the cookie (or the cookie isn't set),
+		// request that the client sets an auth cookie for subsequent requests and redirect them to the URL without
+		// query params set.
+
+		if wait := p.rateLimitWait(request, queryParamsAuthWithoutPrefix, true); wait > 0 {
+			p.log(Info, "client or user has made too many attempts, rejecting request")
+
+			p.tooManyRequests(responseWriter, wait)
+
+			return
+		}
+
+		if _, err := p.validateToken(queryParamsAuthWithoutPrefix); err != nil {
+			p.log(Info, "query params have an invalid token, rejecting request: %v", err)
+
+			p.expireCookieEntry(responseWriter, cookiePayload, cookieEntries, cookieScope)
+			p.invalidToken(responseWriter)
+
+			return
+		}
+
+		if !p.verifyAuth(queryParamsAuthWithoutPrefix) {
+			// Don't store invalid credentials in the cookie, the client has to fix the URL
+			p.log(Info, "query params have invalid credentials, rejecting request")
+
+			p.recordAuthFailure(request, queryParamsAuthWithoutPrefix)
+			p.unauthorized(responseWriter)
+
+			return
+		}
+
+		// Links stand for credentials provisioned by the operator, so they don't need a second factor
+		if !queryParamsFromLink && !p.verifyOtp(queryParamsAuthWithoutPrefix, queryParamsOtp) {
+			p.log(Info, "query params have an invalid or reused TOTP code, rejecting request")
+
+			p.recordAuthFailure(request, queryParamsAuthWithoutPrefix)
+			p.unauthorized(responseWriter)
+
+			return
+		}
+
+		p.recordAuthSuccess(request, queryParamsAuthWithoutPrefix)
+
+		p.log(Debug, "cookie is unset or differs from provided auth, requesting redirect and set cookie")
+
+		cookieValue, err := p.newCookieValue(queryParamsAuthWithoutPrefix, p.sessionClient(request))
+		if err == nil {
+			// Only the entry for this service is replaced if the cookie holds an entry per service
+			err = p.setAuthCookie(responseWriter, p.withCookieEntry(newCookiePayload(cookieValue, p.now()), cookieEntries, cookieScope))
+		}
+
+		if err != nil {
+			p.log(Error, "encountered error encoding cookie: %v", err)
+
+			http.Error(responseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+			return
+		}
+
+		// The previous session, if any, is replaced by the new one
+		p.deleteCookieSession(cookiePayload)
+
+		// Request a redirect. HTTP 307 (Temporary Redirect) preserves the method and body.
+		responseWriter.Header().Set("Location", request.RequestURI)
+		responseWriter.WriteHeader(307)
+
+		_, err = responseWriter.Write(nil)
+		if err != nil {
+			p.log(Warning, "encountered error sending redirect response: %v", err)
+		}
+
+		return
+	}
+
+	if !cookieAuthWithoutPrefix.IsEmpty() || cookieTokenClaims != nil {
+		// Add auth from the cookie before finally sending the request downstream
+
+		claims := cookieTokenClaims
+		if claims == nil {
+			var err error
+
+			claims, err = p.validateToken(cookieAuthWithoutPrefix)
+			if err != nil {
+				// The token may have expired since the cookie was set
+				p.log(Info, "cookie has an invalid token, rejecting request: %v", err)
+
+				p.expireCookieEntry(responseWriter, cookiePayload, cookieEntries, cookieScope)
+				p.invalidToken(responseWriter)
+
+				return
+			}
+
+			// A cookie the plugin sealed or issued can't be used to guess passwords, so only forgeable ones are subject
+			// to lockouts, otherwise failures elsewhere would lock out users that are already logged in
+			cookieForgeable := p.isCookieForgeable()
+
+			if cookieForgeable {
+				if wait := p.rateLimitWait(request, cookieAuthWithoutPrefix, false); wait > 0 {
+					p.log(Info, "client or user is locked out, rejecting request")
+
+					p.tooManyRequests(responseWriter, wait)
+
+					return
+				}
+			}
+
+			if !p.verifyAuth(cookieAuthWithoutPrefix) {
+				// The user may have been removed or their password changed since the cookie was set
+				p.log(Info, "cookie has invalid credentials, rejecting request")
+
+				if cookieForgeable {
+					p.recordAuthFailure(request, cookieAuthWithoutPrefix)
+				}
+				p.unauthorized(responseWriter)
+
+				return
+			}
+		} else if p.sessionTokens.NeedsRenewal(claims) {
+			// Issued tokens are short-lived, so swap in a fresh one while the client is active
+			username, _ := claims["sub"].(string)
+
+			if cookieValue, err := p.newSessionTokenCookieValue(username); err != nil {
+				p.log(Warning, "encountered error renewing token: %v", err)
+			} else {
+				cookiePayload.Value = cookieValue
+				cookieStale = true
+			}
+		}
+
+		p.log(Debug, "found cookie, moving to authorization header and proxying request")
+
+		if !cookieAuthWithoutPrefix.IsEmpty() {
+			request.Header.Add(AuthorizationHeader, cookieAuthWithoutPrefix.WithPrefix().String())
+		}
+		p.setClaimHeaders(request, claims)
+
+		// If the downstream service rejects the credentials, they'll keep being rejected, so stop sending them
+		responseWriter = p.newUpstreamResponseWriter(responseWriter, request, cookieAuthWithoutPrefix, cookiePayload, cookieEntries, cookieScope)
+
+		if cookieStale {
+			// The cookie was sealed with an old secret or format or is due for renewal, re-issue it alongside the proxied
+			// response
+			p.log(Debug, "cookie is stale, re-issuing")
+
+			cookiePayload.LastSeen = p.now()
+
+			if err := p.setAuthCookie(responseWriter, p.withCookieEntry(cookiePayload, cookieEntries, cookieScope)); err != nil {
+				p.log(Warning, "encountered error re-issuing cookie: %v", err)
+			}
+		}
+	} else if p.wantsLogin(request) {
+		p.log(Debug, "no credentials found, redirecting to login page")
+
+		p.redirectToLogin(responseWriter, request)
+
+		return
+	} else if p.getUsers() != nil {
+		p.log(Debug, "no credentials found, rejecting request")
+
+		p.unauthorized(responseWriter)
+
+		return
+	}
+
+	p.next.ServeHTTP(responseWriter, request)
+}
+
+// newUpstreamResponseWriter wraps the response writer to handle the downstream service rejecting the credentials from
+// the cookie.
+func (p *AuthHackPlugin) newUpstreamResponseWriter(responseWriter http.ResponseWriter, request *http.Request, auth encodedAuthWithoutPrefix, payload cookiePayload, entries cookieEntries, scope string) http.ResponseWriter {
+	// Capture the URL and client now, since the downstream service may modify the request
+	returnTo := request.URL.RequestURI()
+	wantsLogin := p.wantsLogin(request)
+
+	// Rejected credentials count towards a lockout
+	var rateLimiterKeys []string
+	if p.rateLimiter != nil {
+		rateLimiterKeys = p.rateLimiterKeys(request, auth)
+	}
+
+	return newUpstreamResponseWriter(responseWriter, func(responseWriter http.ResponseWriter) bool {
+		p.log(Info, "downstream service rejected credentials from cookie, expiring it")
+
+		p.deleteCookieSession(payload)
+		if rateLimiterKeys != nil {
+			p.rateLimiter.Fail(rateLimiterKeys...)
+		}
+
+		header := responseWriter.Header()
+
+		switch p.config.UpstreamUnauthorizedAction {
+		case UpstreamUnauthorizedLogin:
+			if wantsLogin {
+				// Replace the response entirely, so none of the downstream service's headers apply
+				for key := range header {
+					delete(header, key)
+				}
+
+				p.expireCookieEntry(responseWriter, payload, entries, scope)
+
+				header.Set("Location", p.loginLocation(returnTo))
+				responseWriter.WriteHeader(http.StatusFound)
+
+				return true
+			}
+		case UpstreamUnauthorizedStrip:
+			// Browsers show a native prompt for a WWW-Authenticate header, which doesn't work inside iframes
+			header.Del("WWW-Authenticate")
+		}
+
+		p.expireCookieEntry(responseWriter, payload, entries, scope)
+
+		return false
+	})
+}
+
+func (p *AuthHackPlugin) log(level LogLevel, format string, args ...any) {
+	p.config.log(level, p.name, format, args...)
+}
+
+func (p *AuthHackPlugin) getCookieCipher() *cookieCipher {
+	return p.cookieCipher.Load().(*cookieCipher)
+}
+
+func (p *AuthHackPlugin) getUsers() *htpasswd {
+	return p.users.Load().(*htpasswd)
+}
+
+// verifyAuth returns whether the auth is valid, which is always the case if no users file is configured. Bearer tokens
+// are left to validateToken, which must be called first, so they're always valid here.
+func (p *AuthHackPlugin) verifyAuth(auth encodedAuthWithoutPrefix) bool {
+	if p.isValidatedToken(auth) {
+		return true
+	}
+
+	// Read the cache generation before the users so that, if the users are replaced while verifying, the result isn't
+	// cached
+	var generation uint64
+	if p.verificationCache != nil {
+		generation = p.verificationCache.Generation()
+	}
+
+	users := p.getUsers()
+	if users == nil {
+		return true
+	}
+
+	username, password, ok := auth.Decode()
+	if !ok {
+		return false
+	}
+
+	if p.verificationCache != nil && p.verificationCache.Contains(username, password) {
+		return true
+	}
+
+	if !users.Verify(username, password) {
+		return false
+	}
+
+	if p.verificationCache != nil {
+		p.verificationCache.Add(username, password, generation)
+	}
+
+	return true
+}
+
+// setUsers replaces the users credentials are verified against, forgetting any credentials verified against the
+// previous users.
+func (p *AuthHackPlugin) setUsers(users *htpasswd) {
+	p.users.Store(users)
+
+	if p.verificationCache != nil {
+		p.verificationCache.Clear()
+	}
+}
+
+// verifyOtp returns whether the TOTP code is valid for the user the auth is for, which is always the case if TOTP is
+// disabled, the auth isn't Basic credentials or the user has no TOTP secret. verifyAuth must be called first, so that
+// codes are only used up by users who know the password.
+func (p *AuthHackPlugin) verifyOtp(auth encodedAuthWithoutPrefix, otp string) bool {
+	if p.totpVerifier == nil {
+		return true
+	}
+
+	username, _, ok := auth.Decode()
+	if !ok {
+		return true
+	}
+
+	secret, ok := p.getUsers().TOTPSecret(username)
+	if !ok {
+		return true
+	}
+
+	return p.totpVerifier.Verify(username, secret, otp)
+}
+
+// isValidatedToken returns whether the auth is a bearer token that validateToken checks.
+func (p *AuthHackPlugin) isValidatedToken(auth encodedAuthWithoutPrefix) bool {
+	return p.jwtValidator != nil && strings.EqualFold(auth.Scheme(), bearerScheme)
+}
+
+// validateToken validates the auth as a JWT if it's a bearer token and a JWT secret or keys are configured, returning
+// its claims. Other auth is left to verifyAuth and returns no claims and no error.
+func (p *AuthHackPlugin) validateToken(auth encodedAuthWithoutPrefix) (jwtClaims, error) {
+	if !p.isValidatedToken(auth) {
+		return nil, nil
+	}
+
+	return p.jwtValidator.Validate(strings.TrimSpace(auth.String()[len(auth.Scheme()):]))
+}
+
+// reservedClaimHeaders can't be mapped from claims. Claim headers are removed from every request, so mapping one of
+// these would strip it from all traffic: hop-by-hop headers and those this plugin or the proxies in front rely on.
+var reservedClaimHeaders = map[string]bool{
+	AuthorizationHeader:   true,
+	"Cookie":              true,
+	"Host":                true,
+	ForwardedHeader:       true,
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+func isReservedClaimHeader(header string) bool {
+	header = http.CanonicalHeaderKey(header)
+
+	return reservedClaimHeaders[header] || strings.HasPrefix(header, "X-Forwarded-")
+}
+
+func (p *AuthHackPlugin) scrubClaimHeaders(request *http.Request) {
+	for _, header := range p.config.JWTClaimHeaders {
+		request.Header.Del(header)
+	}
+}
+
+// setClaimHeaders sets the headers mapped from the claims, skipping claims the token doesn't have.
+func (p *AuthHackPlugin) setClaimHeaders(request *http.Request, claims jwtClaims) {
+	for claim, header := range p.config.JWTClaimHeaders {
+		if value, ok := claims.headerValue(claim); ok {
+			if strings.ContainsAny(value, "\r\n") {
+				p.log(Info, "not setting header '%s' from claim '%s': contains a line break", header, claim)
+
+				continue
+			}
+
+			p.log(Debug, "setting header '%s' from claim '%s' ('%s')", header, claim, value)
+
+			request.Header.Set(header, value)
+		}
+	}
+}
+
+// invalidToken rejects a request with an invalid bearer token. Callers expire the cookie's entry first so the client
+// doesn't keep sending it.
+func (p *AuthHackPlugin) invalidToken(responseWriter http.ResponseWriter) {
+	responseWriter.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q, error=\"invalid_token\"", p.config.Realm))
+
+	http.Error(responseWriter, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+func (p *AuthHackPlugin) unauthorized(responseWriter http.ResponseWriter) {
+	responseWriter.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", p.config.Realm))
+
+	http.Error(responseWriter, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+func (p *AuthHackPlugin) hasAuthHeader(request *http.Request) bool {
+	return request.Header.Get(AuthorizationHeader) != ""
+}
+
+// isQueryAuthAllowed returns whether credentials from the request's query params may be used, see QueryAuthAllowedIPs
+// and QueryAuthDeniedIPs.
+func (p *AuthHackPlugin) isQueryAuthAllowed(request *http.Request) bool {
+	if len(p.queryAuthAllowedIPs) == 0 && len(p.queryAuthDeniedIPs) == 0 {
+		return true
+	}
+
+	ip := p.clientIP(request)
+
+	return !p.queryAuthDeniedIPs.Contains(ip) && (len(p.queryAuthAllowedIPs) == 0 || p.queryAuthAllowedIPs.Contains(ip))
+}
+
+// hasAuthQueryParams returns whether the request has any of the query params that credentials are read from.
+func (p *AuthHackPlugin) hasAuthQueryParams(request *http.Request) bool {
+	params := []string{p.config.AuthorizationQueryParam, p.config.AccessTokenQueryParam, p.config.UsernameQueryParam}
+	if p.config.AuthLinksFile != "" {
+		params = append(params, p.config.AuthLinkQueryParam)
+	}
+	if p.oneTimeLedger != nil {
+		params = append(params, p.config.OneTimeLinkQueryParam)
+	}
+
+	query := request.URL.Query()
+	for _, param := range params {
+		if param != "" && query.Get(param) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getAndScrubAuthQueryParams returns the auth and TOTP code from the query params. fromLink is true if the auth is
+// from an auth link rather than the credentials themselves.
+func (p *AuthHackPlugin) getAndScrubAuthQueryParams(request *http.Request) (result encodedAuthWithoutPrefix, otp string, fromLink bool) {
+	query := newQueryWrapper(request)
+
+	result = p.getAndScrubAuthQueryParam(query)
+
+	// Even if we already have a result, continue to run the remaining handlers so they all get a chance to sanitize the request
+	accessTokenResult := p.getAndScrubAccessTokenQueryParam(query)
+	if result.IsEmpty() {
+		result = accessTokenResult
+	} else if !accessTokenResult.IsEmpty() && result != accessTokenResult {
+		p.log(Info, "found both authorization query param and access token query param that are mismatched, using authorization query param")
+	}
+
+	userAndPassResult := p.getAndScrubUserPassQueryParams(query)
+	if result.IsEmpty() {
+		result = userAndPassResult
+	} else if result != userAndPassResult {
+		p.log(Info, "found both authorization query param and username / password query params that are mismatched, using authorization query param")
+	}
+
+	authLinkResult := p.getAndScrubAuthLinkQueryParam(query)
+	if result.IsEmpty() {
+		result = authLinkResult
+		fromLink = !authLinkResult.IsEmpty()
+	} else if !authLinkResult.IsEmpty() && result != authLinkResult {
+		p.log(Info, "found both credential query params and auth link query param that are mismatched, using credential query params")
+	}
+
+	otp = p.getAndScrubOtpQueryParam(query)
+
+	query.Apply()
+
+	return result, otp, fromLink
+}
+
+func (p *AuthHackPlugin) getAndScrubOtpQueryParam(query *requestQueryWrapper) string {
+	if p.config.OtpQueryParam == "" {
+		return ""
+	}
+
+	otp := query.Get(p.config.OtpQueryParam)
+	if otp != "" {
+		p.log(Debug, "found TOTP code query param ('%s': '%s')", p.config.OtpQueryParam, otp)
+
+		query.Del(p.config.OtpQueryParam)
+	}
+
+	return otp
+}
+
+func (p *AuthHackPlugin) getAndScrubAuthQueryParam(query *requestQueryWrapper) encodedAuthWithoutPrefix {
+	var result encodedAuthWithoutPrefix
+
+	if authorization := query.Get(p.config.AuthorizationQueryParam); authorization != "" {
+		result = newEncodedAuthWithoutPrefix(authorization)
+
+		p.log(Debug, "found authorization query param ('%s': '%s'), moving to header", p.config.AuthorizationQueryParam, result)
+
+		query.Del(p.config.AuthorizationQueryParam)
+	}
+
+	return result
+}
+
+func (p *AuthHackPlugin) getAndScrubAccessTokenQueryParam(query *requestQueryWrapper) encodedAuthWithoutPrefix {
+	var result encodedAuthWithoutPrefix
+
+	if p.config.AccessTokenQueryParam == "" {
+		return result
+	}
+
+	if accessToken := query.Get(p.config.AccessTokenQueryParam); accessToken != "" {
+		result = newEncodedAuthWithoutPrefix(bearerPrefix + accessToken)
+
+		p.log(Debug, "found access token query param ('%s': '%s'), moving to header", p.config.AccessTokenQueryParam, accessToken)
+
+		query.Del(p.config.AccessTokenQueryParam)
+	}
+
+	return result
+}
+
+func (p *AuthHackPlugin) getAndScrubUserPassQueryParams(query *requestQueryWrapper) encodedAuthWithoutPrefix {
+	var result encodedAuthWithoutPrefix
+
+	if username := query.Get(p.config.UsernameQueryParam); username != "" {
+		// Allow for not specifying a password
+		password := query.Get(p.config.PasswordQueryParam)
+
+		result = encodeAuthWithoutPrefix(username, password)
+
+		p.log(Debug, "found username and password query params ('%s': '%s' / '%s': '%s'), moving to header ('%s')", p.config.UsernameQueryParam, username, p.config.PasswordQueryParam, password, result.String())
+
+		query.Del(p.config.UsernameQueryParam)
+		query.Del(p.config.PasswordQueryParam)
+	}
+
+	return result
+}
+
+// getAndScrubAuthCookie returns the payload stored in the cookie and whether the cookie is stale and should be
+// re-issued. Cookies that are invalid or expired are scrubbed and treated as absent.
+func (p *AuthHackPlugin) getAndScrubAuthCookie(request *http.Request) (cookiePayload, bool) {
+	cookies := request.Cookies()
+	for _, cookie := range cookies {
+		if cookie.Name == p.config.CookieName {
+			p.log(Debug, "found cookie ('%s': '%s'), removing from request", cookie.Name, cookie.Value)
+
+			p.removeCookie(request, cookies, cookie)
+
+			return p.decodeCookieValue(cookie.Value)
+		}
+	}
+
+	return cookiePayload{}, false
+}
+
+// newCookieValue returns the value to store in a new cookie for the auth, creating a session or issuing a token for it
+// if enabled.
+func (p *AuthHackPlugin) newCookieValue(auth encodedAuthWithoutPrefix, client sessionClient) (string, error) {
+	if p.sessionTokens != nil {
+		if username, _, ok := auth.Decode(); ok {
+			return p.newSessionTokenCookieValue(username)
+		}
+
+		// Other schemes (e.g. bearer tokens) don't carry a password, so they're stored as-is
+		return auth.String(), nil
+	}
+
+	if p.sessions == nil {
+		return auth.String(), nil
+	}
+
+	sessionID, err := p.sessions.Create(auth, client)
+	if err != nil {
+		return "", err
+	}
+
+	return sessionCookieValuePrefix + sessionID, nil
+}
+
+// sessionClient describes the client making the request, for listing sessions.
+func (p *AuthHackPlugin) sessionClient(request *http.Request) sessionClient {
+	return sessionClient{IP: p.clientIP(request), UserAgent: request.UserAgent()}
+}
+
+// newSessionTokenCookieValue issues a token for the user, who must exist in the users file.
+func (p *AuthHackPlugin) newSessionTokenCookieValue(username string) (string, error) {
+	fingerprint, ok := p.getUsers().Fingerprint(username)
+	if !ok {
+		return "", fmt.Errorf("user '%s' doesn't exist", username)
+	}
+
+	token, err := p.sessionTokens.Issue(username, fingerprint)
+	if err != nil {
+		return "", err
+	}
+
+	return sessionTokenCookieValuePrefix + token, nil
+}
+
+// isCookieForgeable returns whether the client can set the cookie to credentials of its choosing, which is the case
+// when it holds the credentials as-is.
+func (p *AuthHackPlugin) isCookieForgeable() bool {
+	return p.getCookieCipher() == nil && p.sessions == nil && p.sessionTokens == nil
+}
+
+// resolveCookieAuth returns the auth referred to by the cookie, looking up the session if enabled. If the cookie holds
+// a token issued by the plugin, its claims are also returned and the auth is the user's upstream credentials, if any.
+func (p *AuthHackPlugin) resolveCookieAuth(payload cookiePayload) (encodedAuthWithoutPrefix, jwtClaims) {
+	if payload.IsEmpty() {
+		return emptyEncodedAuthWithoutPrefix, nil
+	}
+
+	if p.sessionTokens != nil {
+		return p.resolveSessionTokenCookieAuth(payload)
+	}
+
+	sessionID, isSession := sessionIDFromCookieValue(payload.Value)
+
+	if p.sessions == nil {
+		if isSession {
+			p.log(Info, "rejecting cookie ('%s'): references a session but sessions are disabled", p.config.CookieName)
+
+			return emptyEncodedAuthWithoutPrefix, nil
+		}
+
+		return newEncodedAuthWithoutPrefix(payload.Value), nil
+	}
+
+	if !isSession {
+		p.log(Info, "rejecting cookie ('%s'): sessions are enabled but it doesn't reference a session", p.config.CookieName)
+
+		return emptyEncodedAuthWithoutPrefix, nil
+	}
+
+	auth, ok := p.sessions.Get(sessionID)
+	if !ok {
+		p.log(Info, "rejecting cookie ('%s'): session doesn't exist or has expired", p.config.CookieName)
+
+		return emptyEncodedAuthWithoutPrefix, nil
+	}
+
+	return auth, nil
+}
+
+func (p *AuthHackPlugin) resolveSessionTokenCookieAuth(payload cookiePayload) (encodedAuthWithoutPrefix, jwtClaims) {
+	if !strings.HasPrefix(payload.Value, sessionTokenCookieValuePrefix) {
+		auth := newEncodedAuthWithoutPrefix(payload.Value)
+		if _, _, ok := auth.Decode(); ok {
+			p.log(Info, "rejecting cookie ('%s'): tokens are issued but it holds credentials", p.config.CookieName)
+
+			return emptyEncodedAuthWithoutPrefix, nil
+		}
+
+		return auth, nil
+	}
+
+	claims, err := p.sessionTokens.Verify(strings.TrimPrefix(payload.Value, sessionTokenCookieValuePrefix))
+	if err != nil {
+		p.log(Info, "rejecting cookie ('%s'): %v", p.config.CookieName, err)
+
+		return emptyEncodedAuthWithoutPrefix, nil
+	}
+
+	username, _ := claims["sub"].(string)
+
+	fingerprint, ok := p.getUsers().Fingerprint(username)
+	if !ok || claims[sessionTokenFingerprintClaim] != fingerprint {
+		p.log(Info, "rejecting cookie ('%s'): user '%s' was removed or their password changed", p.config.CookieName, username)
+
+		return emptyEncodedAuthWithoutPrefix, nil
+	}
+
+	return p.upstreamCredentials[username], claims
+}
+
+func (p *AuthHackPlugin) deleteCookieSession(payload cookiePayload) {
+	if p.sessions == nil {
+		return
+	}
+
+	if sessionID, isSession := sessionIDFromCookieValue(payload.Value); isSession {
+		p.sessions.Delete(sessionID)
+	}
+}
+
+func sessionIDFromCookieValue(value string) (string, bool) {
+	if !strings.HasPrefix(value, sessionCookieValuePrefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(value, sessionCookieValuePrefix), true
+}
+
+func (p *AuthHackPlugin) setAuthCookie(responseWriter http.ResponseWriter, payload cookiePayload) error {
+	cookieValue, err := p.encodeCookieValue(payload)
+	if err != nil {
+		return err
+	}
+
+	cookie := &http.Cookie{
+		Name:     p.config.CookieName,
+		Value:    cookieValue,
+		Domain:   p.config.CookieDomain,
+		Path:     p.config.CookiePath,
+		Secure:   true, // HTTPS only
+		HttpOnly: true, // Unavailable to JavaScript
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	// Have the client discard the cookie once it would be rejected anyway
+	if maxAge := p.cookieRemainingLifetime(payload); maxAge > 0 {
+		cookie.MaxAge = int(maxAge / time.Second)
+	}
+
+	responseWriter.Header().Add("Set-Cookie", cookie.String())
+
+	return nil
+}
+
+// clearAuthCookie has the client discard the auth cookie, replacing any auth cookie already set on the response.
+func (p *AuthHackPlugin) clearAuthCookie(responseWriter http.ResponseWriter) {
+	p.removeAuthSetCookies(responseWriter)
+
+	cookie := &http.Cookie{
+		Name:     p.config.CookieName,
+		Value:    "",
+		Domain:   p.config.CookieDomain,
+		Path:     p.config.CookiePath,
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	responseWriter.Header().Add("Set-Cookie", cookie.String())
+}
+
+// removeAuthSetCookies removes any auth cookie already set on the response.
+func (p *AuthHackPlugin) removeAuthSetCookies(responseWriter http.ResponseWriter) {
+	header := responseWriter.Header()
+
+	setCookies := header.Values("Set-Cookie")
+	header.Del("Set-Cookie")
+
+	for _, setCookie := range setCookies {
+		if !strings.HasPrefix(setCookie, p.config.CookieName+"=") {
+			header.Add("Set-Cookie", setCookie)
+		}
+	}
+}
+
+// cookieRemainingLifetime returns how much longer a cookie with the given payload is valid for, or zero if no
+// lifetime is configured.
+func (p *AuthHackPlugin) cookieRemainingLifetime(payload cookiePayload) time.Duration {
+	var remaining time.Duration
+
+	if p.cookieMaxLifetime != 0 {
+		remaining = p.cookieMaxLifetime - payload.LastSeen.Sub(payload.IssuedAt)
+	}
+
+	if p.cookieIdleTimeout != 0 && (remaining == 0 || p.cookieIdleTimeout < remaining) {
+		remaining = p.cookieIdleTimeout
+	}
+
+	return remaining
+}
+
+func (p *AuthHackPlugin) encodeCookieValue(payload cookiePayload) (string, error) {
+	cookieCipher := p.getCookieCipher()
+	if cookieCipher == nil {
+		return payload.Value, nil
+	}
+
+	return cookieCipher.Seal(payload)
+}
+
+func (p *AuthHackPlugin) decodeCookieValue(value string) (cookiePayload, bool) {
+	cookieCipher := p.getCookieCipher()
+	if cookieCipher == nil {
+		return cookiePayload{Value: value}, false
+	}
+
+	payload, stale, err := cookieCipher.Open(value)
+	if err != nil {
+		// Tampered with or sealed with an unknown secret, treat the cookie as absent
+		p.log(Info, "rejecting cookie ('%s'): %v", p.config.CookieName, err)
+
+		return cookiePayload{}, false
+	}
+
+	now := p.now()
+
+	if !payload.HasTimestamps() {
+		// Without timestamps, the lifetime would restart every time the cookie is replayed, so it could never expire
+		if p.cookieMaxLifetime != 0 || p.cookieIdleTimeout != 0 {
+			p.log(Info, "rejecting cookie ('%s'): previous format has no timestamps to enforce its lifetime with", p.config.CookieName)
+
+			return cookiePayload{}, false
+		}
+
+		// No lifetime is enforced, so it's safe to upgrade, the cookie is re-issued since it's stale
+		payload = newCookiePayload(payload.Value, now)
+	}
+
+	if p.cookieMaxLifetime != 0 && now.Sub(payload.IssuedAt) >= p.cookieMaxLifetime {
+		p.log(Info, "rejecting cookie ('%s'): exceeded max lifetime (issued at %v)", p.config.CookieName, payload.IssuedAt)
+
+		return cookiePayload{}, false
+	}
+
+	if p.cookieIdleTimeout != 0 {
+		idle := now.Sub(payload.LastSeen)
+
+		if idle >= p.cookieIdleTimeout {
+			p.log(Info, "rejecting cookie ('%s'): exceeded idle timeout (last seen at %v)", p.config.CookieName, payload.LastSeen)
+
+			return cookiePayload{}, false
+		}
 
-			return newEncodedAuthWithoutPrefix(cookie.Value)
+		if idle >= p.cookieIdleTimeout/2 {
+			// Sliding renewal, the cookie is re-issued with an updated last seen time
+			stale = true
 		}
 	}
 
-	return emptyEncodedAuthWithoutPrefix
+	return payload, stale
 }
 
 func (p *AuthHackPlugin) removeCookie(request *http.Request, cookies []*http.Cookie, cookie *http.Cookie) {
@@ -0,0 +1,2948 @@
+package traefik_authhack
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testAuth = encodedAuthWithoutPrefix("dGVzdHVzZXJuYW1lOnRlc3RwYXNzd29yZA==")
+const testCookieSecret = "testcookiesecret"
+const testJWTSecret = "testjwtsecret"
+
+// testUsersFileContents has the user from testAuth
+const testUsersFileContents = "testusername:$apr1$abcdefgh$idb/QWG.ElA4XFg88Le/A/"
+
+// testUpstreamAuth is 'upstreamuser:upstreampassword'
+const testUpstreamAuth = encodedAuthWithoutPrefix("dXBzdHJlYW11c2VyOnVwc3RyZWFtcGFzc3dvcmQ=")
+
+func TestCookieCipher_OpenPreviousFormat(t *testing.T) {
+	c, err := newCookieCipher([]string{testCookieSecret}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// v2 values seal the bare auth behind the version prefix
+	sealed := sealRaw(t, c, []byte(testAuth))
+
+	payload, stale, err := c.Open(cookieValueV2Prefix + sealed)
+	if err != nil {
+		t.Fatalf("expected v2 value to open but found error: %v", err)
+	}
+
+	if payload.Value != testAuth.String() {
+		t.Errorf("expected value '%s' but found '%s'", testAuth, payload.Value)
+	}
+	if !stale {
+		t.Errorf("expected v2 value to be stale")
+	}
+	if payload.HasTimestamps() {
+		t.Errorf("expected v2 value to have no timestamps")
+	}
+
+	// Values without a version prefix aren't accepted
+	if _, _, err := c.Open(sealed); !errors.Is(err, errCookieMalformed) {
+		t.Errorf("expected unversioned value to be rejected but found: %v", err)
+	}
+}
+
+func TestAuthHack_PreviousFormatCookie(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxLifetime    string
+		idleTimeout    string
+		expectAccepted bool
+	}{
+		{"NoLifetime", "", "", true},
+		{"MaxLifetime", "1h", "", false},
+		{"IdleTimeout", "", "1h", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.CookieSecret = testCookieSecret
+			config.CookieMaxLifetime = test.maxLifetime
+			config.CookieIdleTimeout = test.idleTimeout
+
+			p, _ := newTestPlugin(t, config)
+
+			cookie := &http.Cookie{Name: config.CookieName, Value: cookieValueV2Prefix + sealRaw(t, p.getCookieCipher(), []byte(testAuth))}
+
+			auth, reissued := serveTestCookie(t, p, cookie)
+			if !test.expectAccepted {
+				// Without timestamps, a replayed cookie's lifetime would restart on every request
+				assertTestCookieRejected(t, auth, reissued)
+
+				return
+			}
+
+			assertTestCookieAccepted(t, auth, reissued, true)
+			if reissued != nil && !strings.HasPrefix(reissued.Value, cookieValueV3Prefix) {
+				t.Errorf("expected cookie to be re-issued in the current format but found '%s'", reissued.Value)
+			}
+		})
+	}
+}
+
+func TestCookieCipher_OpenBadSignature(t *testing.T) {
+	c, err := newCookieCipher([]string{testCookieSecret}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Correctly encrypted, but signed with the wrong key
+	plaintext := newCookiePayload(testAuth.String(), time.Now()).marshal()
+	plaintext = append(plaintext, make([]byte, 32)...)
+
+	_, _, err = c.Open(cookieValueV3Prefix + sealRaw(t, c, plaintext))
+	if !errors.Is(err, errCookieBadSignature) {
+		t.Errorf("expected bad signature error but found: %v", err)
+	}
+}
+
+func TestAuthHack_CookieIdleTimeout(t *testing.T) {
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.CookieIdleTimeout = "1h"
+
+	p, clock := newTestPlugin(t, config)
+	start := *clock
+
+	cookie := issueTestCookie(t, p, newCookiePayloadForAuth(t, p, testAuth))
+
+	// Used before the renewal window, the cookie is accepted as-is
+	*clock = start.Add(20 * time.Minute)
+	auth, reissued := serveTestCookie(t, p, cookie)
+	assertTestCookieAccepted(t, auth, reissued, false)
+
+	// Used after half the idle timeout, the cookie is renewed
+	*clock = start.Add(40 * time.Minute)
+	auth, renewed := serveTestCookie(t, p, cookie)
+	assertTestCookieAccepted(t, auth, renewed, true)
+	if renewed == nil {
+		return
+	}
+
+	// The renewed cookie outlives the original
+	*clock = start.Add(90 * time.Minute)
+	auth, reissued = serveTestCookie(t, p, cookie)
+	assertTestCookieRejected(t, auth, reissued)
+
+	auth, reissued = serveTestCookie(t, p, renewed)
+	assertTestCookieAccepted(t, auth, reissued, true)
+}
+
+func TestAuthHack_CookieMaxLifetime(t *testing.T) {
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.CookieMaxLifetime = "1h"
+	config.CookieIdleTimeout = "30m"
+
+	p, clock := newTestPlugin(t, config)
+	start := *clock
+
+	cookie := issueTestCookie(t, p, newCookiePayloadForAuth(t, p, testAuth))
+
+	// Renewals keep the cookie alive within the max lifetime...
+	for elapsed := 20 * time.Minute; elapsed < time.Hour; elapsed += 20 * time.Minute {
+		*clock = start.Add(elapsed)
+
+		auth, reissued := serveTestCookie(t, p, cookie)
+		assertTestCookieAccepted(t, auth, reissued, true)
+		if reissued == nil {
+			return
+		}
+
+		if reissued.MaxAge <= 0 || time.Duration(reissued.MaxAge)*time.Second > time.Hour-elapsed {
+			t.Errorf("expected re-issued cookie max age to be within the remaining lifetime but found %v", reissued.MaxAge)
+		}
+
+		cookie = reissued
+	}
+
+	// ...but not past it
+	*clock = start.Add(time.Hour)
+	auth, reissued := serveTestCookie(t, p, cookie)
+	assertTestCookieRejected(t, auth, reissued)
+}
+
+func TestAuthHack_CookieLifetimeRequiresSecret(t *testing.T) {
+	config := CreateConfig()
+	config.CookieIdleTimeout = "1h"
+
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "test")
+	if err == nil {
+		t.Errorf("expected an error configuring a cookie lifetime without a cookie secret")
+	}
+}
+
+func TestSessionStore_TTL(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	store := newSessionStore(time.Hour, 10, func() time.Time { return clock })
+	start := clock
+
+	id, err := store.Create(testAuth, sessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each use extends the session
+	for _, elapsed := range []time.Duration{30 * time.Minute, 89 * time.Minute} {
+		clock = start.Add(elapsed)
+
+		if auth, ok := store.Get(id); !ok || auth != testAuth {
+			t.Errorf("expected session to be valid after %v but found '%s' (%v)", elapsed, auth, ok)
+		}
+	}
+
+	clock = start.Add(149 * time.Minute)
+
+	if auth, ok := store.Get(id); ok {
+		t.Errorf("expected session to have expired but found '%s'", auth)
+	}
+
+	if store.Len() != 0 {
+		t.Errorf("expected expired session to be removed but found %d sessions", store.Len())
+	}
+}
+
+func TestSessionStore_Eviction(t *testing.T) {
+	store := newSessionStore(time.Hour, 2, time.Now)
+
+	first, _ := store.Create("first", sessionClient{})
+	second, _ := store.Create("second", sessionClient{})
+
+	// Using the first session makes the second the least recently used
+	store.Get(first)
+
+	third, err := store.Create("third", sessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Len() != 2 {
+		t.Errorf("expected store to be bounded to 2 sessions but found %d", store.Len())
+	}
+
+	if _, ok := store.Get(second); ok {
+		t.Errorf("expected least recently used session to be evicted")
+	}
+
+	for _, id := range []string{first, third} {
+		if _, ok := store.Get(id); !ok {
+			t.Errorf("expected session '%s' to be retained", id)
+		}
+	}
+}
+
+func TestSessionStore_Concurrent(t *testing.T) {
+	store := newSessionStore(time.Hour, 50, time.Now)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				id, err := store.Create(testAuth, sessionClient{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				store.Get(id)
+				if j%2 == 0 {
+					store.Delete(id)
+				}
+				store.Len()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if store.Len() > 50 {
+		t.Errorf("expected store to be bounded to 50 sessions but found %d", store.Len())
+	}
+}
+
+func TestAuthHack_Sessions(t *testing.T) {
+	config := CreateConfig()
+	config.UseSessions = true
+
+	p, _ := newTestPlugin(t, config)
+
+	request, err := http.NewRequest(http.MethodGet, "https://localhost/?authorization="+testAuth.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.RequestURI = request.URL.String()
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, request)
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected a cookie to be issued but found %d", len(cookies))
+	}
+
+	cookie := cookies[0]
+	if !strings.HasPrefix(cookie.Value, sessionCookieValuePrefix) || strings.Contains(cookie.Value, testAuth.String()) {
+		t.Errorf("expected cookie to only hold a session ID but found '%s'", cookie.Value)
+	}
+
+	auth, reissued := serveTestCookie(t, p, cookie)
+	assertTestCookieAccepted(t, auth, reissued, false)
+
+	// Sessions from another instance (e.g. before a restart) are unknown
+	other, _ := newTestPlugin(t, config)
+
+	auth, reissued = serveTestCookie(t, other, cookie)
+	assertTestCookieRejected(t, auth, reissued)
+}
+
+func TestAuthHack_SessionTokens(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte(testUsersFileContents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.UsersFile = usersFile
+	config.SessionTokenSecret = testJWTSecret
+	config.SessionTokenLifetime = "1h"
+	config.UpstreamCredentials = map[string]string{"testusername": "Basic " + testUpstreamAuth.String()}
+	config.JWTClaimHeaders = map[string]string{"sub": "X-Auth-Request-User"}
+
+	p, clock := newTestPlugin(t, config)
+
+	request, err := http.NewRequest(http.MethodGet, "https://localhost/?authorization="+testAuth.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.RequestURI = request.URL.String()
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, request)
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected a cookie to be issued but found %d", len(cookies))
+	}
+
+	cookie := cookies[0]
+	if !strings.HasPrefix(cookie.Value, sessionTokenCookieValuePrefix) || strings.Contains(cookie.Value, testAuth.String()) {
+		t.Errorf("expected cookie to only hold a token but found '%s'", cookie.Value)
+	}
+
+	var user string
+	p.next = http.HandlerFunc(func(_ http.ResponseWriter, request *http.Request) {
+		user = request.Header.Get("X-Auth-Request-User")
+	})
+
+	request, err = http.NewRequest(http.MethodGet, "https://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	p.ServeHTTP(httptest.NewRecorder(), request)
+
+	if user != "testusername" {
+		t.Errorf("expected user header to be 'testusername' but found '%s'", user)
+	}
+
+	auth, reissued := serveTestCookie(t, p, cookie)
+	if auth != testUpstreamAuth.WithPrefix().String() {
+		t.Errorf("expected upstream credentials '%s' but found '%s'", testUpstreamAuth.WithPrefix(), auth)
+	}
+
+	if reissued != nil {
+		t.Errorf("expected cookie not to be re-issued but found '%s'", reissued.Value)
+	}
+
+	// Once half of the lifetime has elapsed, the token is renewed
+	*clock = clock.Add(31 * time.Minute)
+
+	auth, renewed := serveTestCookie(t, p, cookie)
+	if auth != testUpstreamAuth.WithPrefix().String() {
+		t.Errorf("expected upstream credentials '%s' but found '%s'", testUpstreamAuth.WithPrefix(), auth)
+	}
+
+	if renewed == nil || renewed.Value == cookie.Value || !strings.HasPrefix(renewed.Value, sessionTokenCookieValuePrefix) {
+		t.Fatalf("expected token to be renewed but found '%v'", renewed)
+	}
+
+	// The original token expires, the renewed one doesn't
+	*clock = clock.Add(30 * time.Minute)
+
+	auth, _ = serveTestCookie(t, p, cookie)
+	assertTestCookieRejected(t, auth, nil)
+
+	auth, _ = serveTestCookie(t, p, renewed)
+	if auth != testUpstreamAuth.WithPrefix().String() {
+		t.Errorf("expected renewed token to be accepted but found auth '%s'", auth)
+	}
+
+	// Changing the user's password invalidates their tokens
+	users, err := parseHtpasswd(strings.NewReader("testusername:{SHA}AAAAAAAAAAAAAAAAAAAAAAAAAAA="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setUsers(users)
+
+	auth, _ = serveTestCookie(t, p, renewed)
+	assertTestCookieRejected(t, auth, nil)
+}
+
+func TestAuthHack_SessionTokens_RejectsCredentialCookie(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte(testUsersFileContents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.UsersFile = usersFile
+	config.SessionTokenSecret = testJWTSecret
+
+	p, _ := newTestPlugin(t, config)
+
+	auth, reissued := serveTestCookie(t, p, &http.Cookie{Name: config.CookieName, Value: testAuth.String()})
+	assertTestCookieRejected(t, auth, reissued)
+
+	// Tokens signed with another secret are rejected
+	token, err := newSessionTokens(testJWTSecret+"-other", time.Hour, p.now).Issue("testusername", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, reissued = serveTestCookie(t, p, &http.Cookie{Name: config.CookieName, Value: sessionTokenCookieValuePrefix + token})
+	assertTestCookieRejected(t, auth, reissued)
+}
+
+func TestAuthHack_Sessions_RejectsCredentialCookie(t *testing.T) {
+	config := CreateConfig()
+	config.UseSessions = true
+
+	p, _ := newTestPlugin(t, config)
+
+	auth, reissued := serveTestCookie(t, p, &http.Cookie{Name: config.CookieName, Value: testAuth.String()})
+	assertTestCookieRejected(t, auth, reissued)
+}
+
+func TestSessionPersister_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions")
+
+	c, err := newCookieCipher([]string{testCookieSecret}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := newSessionStore(time.Hour, 10, time.Now)
+	id, _ := store.Create(testAuth, sessionClient{})
+
+	if err := newSessionPersister(path, store, func() *cookieCipher { return c }, testLog(t)).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(contents), testAuth.String()) || strings.Contains(string(contents), id) {
+		t.Errorf("expected session snapshot to be encrypted")
+	}
+
+	// Secrets may be rotated between saving and loading
+	c, err = newCookieCipher([]string{testCookieSecret + "-new", testCookieSecret}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restoredStore := newSessionStore(time.Hour, 10, time.Now)
+	newSessionPersister(path, restoredStore, func() *cookieCipher { return c }, testLog(t)).Load()
+
+	if auth, ok := restoredStore.Get(id); !ok || auth != testAuth {
+		t.Errorf("expected session to be restored but found '%s' (%v)", auth, ok)
+	}
+}
+
+func TestSessionPersister_Superseded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions")
+
+	c, err := newCookieCipher([]string{testCookieSecret}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher := func() *cookieCipher { return c }
+
+	// A reload creates a new instance while the old one is still running, each with their own sessions
+	oldStore := newSessionStore(time.Hour, 10, time.Now)
+	oldPersister := newSessionPersister(path, oldStore, cipher, testLog(t))
+
+	newStore := newSessionStore(time.Hour, 10, time.Now)
+	newPersister := newSessionPersister(path, newStore, cipher, testLog(t))
+	newID, _ := newStore.Create(testAuth, sessionClient{})
+
+	if err := newPersister.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	oldStore.Create(testAuth, sessionClient{})
+	if err := oldPersister.Save(); !errors.Is(err, errSessionFileSuperseded) {
+		t.Errorf("expected the old instance to stop saving but found: %v", err)
+	}
+
+	// The old instance stops running rather than waiting to be stopped
+	finished := make(chan struct{})
+	go func() {
+		oldPersister.Run(context.Background(), time.Millisecond)
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the old instance to stop running")
+	}
+
+	restoredStore := newSessionStore(time.Hour, 10, time.Now)
+	newSessionPersister(path, restoredStore, cipher, testLog(t)).Load()
+
+	if restoredStore.Len() != 1 {
+		t.Errorf("expected only the new instance's session to be saved but found %d sessions", restoredStore.Len())
+	}
+	if _, ok := restoredStore.Get(newID); !ok {
+		t.Errorf("expected the new instance's session to be saved")
+	}
+}
+
+func TestSessionPersister_LoadCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions")
+	if err := os.WriteFile(path, []byte("corrupt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.UseSessions = true
+	config.SessionFile = path
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler, err := New(ctx, http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatalf("expected corrupt session snapshot to be ignored but found error: %v", err)
+	}
+
+	if count := handler.(*AuthHackPlugin).sessions.Len(); count != 0 {
+		t.Errorf("expected no sessions to be restored but found %d", count)
+	}
+}
+
+func TestAuthHack_SessionsSurviveRestart(t *testing.T) {
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.UseSessions = true
+	config.SessionFile = filepath.Join(t.TempDir(), "sessions")
+	config.SessionSnapshotInterval = "10ms"
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	handler, err := New(ctx, http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := handler.(*AuthHackPlugin)
+
+	cookie := issueTestCookie(t, p, newCookiePayloadForAuth(t, p, testAuth))
+
+	// Stopping the plugin saves a final snapshot, wait for it to be written
+	cancel()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, err := os.Stat(config.SessionFile); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("expected session snapshot to be saved")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Don't let the restarted plugin write to the snapshot while the test is cleaned up
+	config.SessionSnapshotInterval = "1h"
+
+	restarted, _ := newTestPlugin(t, config)
+
+	auth, reissued := serveTestCookie(t, restarted, cookie)
+	if auth != testAuth.WithPrefix().String() {
+		t.Errorf("expected session to survive restart with auth '%s' but found '%s'", testAuth.WithPrefix(), auth)
+	}
+	if reissued != nil {
+		t.Errorf("expected cookie not to be re-issued but found '%s'", reissued.Value)
+	}
+}
+
+func TestHtpasswd_Verify(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("testpassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := parseHtpasswd(strings.NewReader(`
+apr1:$apr1$abcdefgh$idb/QWG.ElA4XFg88Le/A/
+md5:$1$abcdefgh$H6JMmWFBXCyBkxzBuU/es0
+sha1:{SHA}i7YRj4/Wk1rQh2o740pxfTJwj/0=
+bcrypt:` + string(bcryptHash) + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"apr1", "md5", "sha1", "bcrypt"} {
+		if !users.Verify(username, "testpassword") {
+			t.Errorf("expected '%s' to verify with the correct password", username)
+		}
+
+		if users.Verify(username, "wrongpassword") {
+			t.Errorf("expected '%s' not to verify with the wrong password", username)
+		}
+	}
+
+	if users.Verify("unknown", "testpassword") {
+		t.Errorf("expected unknown user not to verify")
+	}
+}
+
+func TestHtpasswd_ParseInvalid(t *testing.T) {
+	for _, contents := range []string{"nohash", "user:", ":{SHA}i7YRj4/Wk1rQh2o740pxfTJwj/0=", "user:plaintext"} {
+		if _, err := parseHtpasswd(strings.NewReader(contents)); err == nil {
+			t.Errorf("expected an error parsing '%s'", contents)
+		}
+	}
+}
+
+func TestVerificationCache(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	cache, err := newVerificationCache(time.Minute, 2, func() time.Time { return clock })
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := clock
+
+	cache.Add("first", "password", cache.Generation())
+
+	if !cache.Contains("first", "password") {
+		t.Errorf("expected verified credentials to be cached")
+	}
+
+	// Credentials are only cached as a whole
+	if cache.Contains("first", "wrong") || cache.Contains("first:password", "") || cache.Contains("", "first:password") {
+		t.Errorf("expected only the verified credentials to be cached")
+	}
+
+	// Adding past the limit evicts the least recently verified
+	clock = start.Add(10 * time.Second)
+	cache.Add("second", "password", cache.Generation())
+	cache.Add("third", "password", cache.Generation())
+
+	if cache.Len() != 2 || cache.Contains("first", "password") {
+		t.Errorf("expected least recently verified credentials to be evicted")
+	}
+
+	// Entries expire a TTL after they were verified
+	clock = start.Add(70 * time.Second)
+
+	if cache.Contains("second", "password") {
+		t.Errorf("expected cached credentials to expire")
+	}
+
+	// Verifications that started before the cache was cleared aren't added
+	generation := cache.Generation()
+	cache.Clear()
+	cache.Add("fourth", "password", generation)
+
+	if cache.Len() != 0 {
+		t.Errorf("expected cache to be cleared but found %d entries", cache.Len())
+	}
+}
+
+func TestAuthHack_VerificationCacheClearedWithUsers(t *testing.T) {
+	config := CreateConfig()
+
+	p, _ := newTestPlugin(t, config)
+
+	var err error
+	p.verificationCache, err = newVerificationCache(time.Hour, 10, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := parseHtpasswd(strings.NewReader("testusername:$apr1$abcdefgh$idb/QWG.ElA4XFg88Le/A/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setUsers(users)
+
+	if !p.verifyAuth(testAuth) || p.verificationCache.Len() != 1 {
+		t.Fatalf("expected verified credentials to be cached")
+	}
+
+	// The user's password changes
+	users, err = parseHtpasswd(strings.NewReader("testusername:{SHA}AAAAAAAAAAAAAAAAAAAAAAAAAAA="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setUsers(users)
+
+	if p.verifyAuth(testAuth) {
+		t.Errorf("expected credentials to be verified against the new users rather than the cache")
+	}
+}
+
+func TestFileWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watched")
+	modTime := time.Unix(1700000000, 0)
+
+	write := func(contents string) {
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// Don't rely on the file system's timestamp granularity
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var applied string
+	watcher := newFileWatcher(path, func(contents []byte) error {
+		if string(contents) == "invalid" {
+			return errors.New("invalid contents")
+		}
+
+		applied = string(contents)
+
+		return nil
+	}, testLog(t))
+
+	write("first")
+	if err := watcher.Load(); err != nil || applied != "first" {
+		t.Fatalf("expected file to be loaded but found '%s': %v", applied, err)
+	}
+
+	assertCheck := func(expectedReloaded, expectedErr bool, expectedApplied string) {
+		t.Helper()
+
+		reloaded, err := watcher.Check()
+		if reloaded != expectedReloaded || (err != nil) != expectedErr || applied != expectedApplied {
+			t.Errorf("expected reloaded %v, error %v and '%s' but found %v, '%v' and '%s'", expectedReloaded, expectedErr, expectedApplied, reloaded, err, applied)
+		}
+	}
+
+	assertCheck(false, false, "first")
+
+	// Touched without changing the contents
+	write("first")
+	assertCheck(false, false, "first")
+
+	write("second")
+	assertCheck(true, false, "second")
+
+	// Invalid contents keep the last good version, and are only reported once
+	write("invalid")
+	assertCheck(false, true, "second")
+	assertCheck(false, false, "second")
+
+	write("third")
+	assertCheck(true, false, "third")
+}
+
+func TestAuthHack_ReloadUsersFile(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte("testusername:$apr1$abcdefgh$idb/QWG.ElA4XFg88Le/A/"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.UsersFile = usersFile
+	config.FileWatchInterval = "10ms"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler, err := New(ctx, http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := handler.(*AuthHackPlugin)
+
+	if !p.verifyAuth(testAuth) {
+		t.Fatalf("expected credentials to be valid")
+	}
+
+	// A broken file is ignored
+	if err := os.WriteFile(usersFile, []byte("testusername"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if !p.verifyAuth(testAuth) {
+		t.Errorf("expected credentials to remain valid after an invalid users file")
+	}
+
+	// Changing the password invalidates the cached verification
+	if err := os.WriteFile(usersFile, []byte("testusername:{SHA}AAAAAAAAAAAAAAAAAAAAAAAAAAA="), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); p.verifyAuth(testAuth); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected credentials to be invalid once the users file is reloaded")
+		}
+	}
+}
+
+func TestAuthHack_ReloadCookieSecretsFile(t *testing.T) {
+	secretsFile := filepath.Join(t.TempDir(), "secrets")
+	if err := os.WriteFile(secretsFile, []byte("# old\n"+testCookieSecret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.CookieSecretsFile = secretsFile
+	config.FileWatchInterval = "10ms"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler, err := New(ctx, http.NotFoundHandler(), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := handler.(*AuthHackPlugin)
+
+	cookie := issueTestCookie(t, p, newCookiePayloadForAuth(t, p, testAuth))
+
+	// Rotate in a new secret
+	if err := os.WriteFile(secretsFile, []byte(testCookieSecret+"-new\n"+testCookieSecret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		auth, reissued := serveTestCookie(t, p, cookie)
+		if auth != testAuth.WithPrefix().String() {
+			t.Fatalf("expected cookie to remain valid but found auth '%s'", auth)
+		}
+
+		if reissued != nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected cookie to be re-issued with the new secret once the secrets file is reloaded")
+		}
+	}
+}
+
+func TestEncodedAuth_Schemes(t *testing.T) {
+	tests := []struct {
+		auth           string
+		expectedScheme string
+		expectedHeader string
+		expectedDecode bool
+	}{
+		{testAuth.String(), "Basic", "Basic " + testAuth.String(), true},
+		{"Basic " + testAuth.String(), "Basic", "Basic " + testAuth.String(), true},
+		{"basic " + testAuth.String(), "basic", "basic " + testAuth.String(), true},
+		{"Bearer token", "Bearer", "Bearer token", false},
+		{"Custom a=b, c=d", "Custom", "Custom a=b, c=d", false},
+	}
+
+	for _, test := range tests {
+		auth := newEncodedAuthWithoutPrefix(test.auth)
+
+		if scheme := auth.Scheme(); scheme != test.expectedScheme {
+			t.Errorf("expected '%s' to have scheme '%s' but found '%s'", test.auth, test.expectedScheme, scheme)
+		}
+
+		if header := auth.WithPrefix().String(); header != test.expectedHeader {
+			t.Errorf("expected '%s' to have header '%s' but found '%s'", test.auth, test.expectedHeader, header)
+		}
+
+		if _, _, ok := auth.Decode(); ok != test.expectedDecode {
+			t.Errorf("expected '%s' to decode (%v) but found %v", test.auth, test.expectedDecode, ok)
+		}
+	}
+}
+
+func sealRaw(t *testing.T, c *cookieCipher, plaintext []byte) string {
+	aead := c.aeads[0]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, c.additionalData))
+}
+
+func newTestPlugin(t *testing.T, config *Config) (*AuthHackPlugin, *time.Time) {
+	handler, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := handler.(*AuthHackPlugin)
+
+	clock := time.Unix(1700000000, 0)
+	p.now = func() time.Time { return clock }
+
+	return p, &clock
+}
+
+func testLog(t *testing.T) func(level LogLevel, format string, args ...any) {
+	return func(level LogLevel, format string, args ...any) {
+		t.Logf("%s: %s", level.String(), fmt.Sprintf(format, args...))
+	}
+}
+
+// newCookiePayloadForAuth returns a payload for the auth as the plugin would issue it, creating a session if enabled.
+func newCookiePayloadForAuth(t *testing.T, p *AuthHackPlugin, auth encodedAuthWithoutPrefix) cookiePayload {
+	value, err := p.newCookieValue(auth, sessionClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newCookiePayload(value, p.now())
+}
+
+func issueTestCookie(t *testing.T, p *AuthHackPlugin, payload cookiePayload) *http.Cookie {
+	recorder := httptest.NewRecorder()
+	if err := p.setAuthCookie(recorder, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected a cookie to be issued but found %d", len(cookies))
+	}
+
+	return cookies[0]
+}
+
+// serveTestCookie sends a request with the cookie, returning the authorization header that was proxied and the
+// re-issued cookie, if any.
+func serveTestCookie(t *testing.T, p *AuthHackPlugin, cookie *http.Cookie) (string, *http.Cookie) {
+	var auth string
+	p.next = http.HandlerFunc(func(_ http.ResponseWriter, request *http.Request) {
+		auth = request.Header.Get(AuthorizationHeader)
+	})
+
+	request, err := http.NewRequest(http.MethodGet, "https://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, request)
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) == 0 {
+		return auth, nil
+	}
+
+	return auth, cookies[0]
+}
+
+func assertTestCookieAccepted(t *testing.T, auth string, reissued *http.Cookie, expectReissued bool) {
+	if auth != testAuth.WithPrefix().String() {
+		t.Errorf("expected cookie to be accepted with auth '%s' but found '%s'", testAuth.WithPrefix(), auth)
+	}
+
+	if expectReissued && reissued == nil {
+		t.Errorf("expected cookie to be re-issued")
+	} else if !expectReissued && reissued != nil {
+		t.Errorf("expected cookie not to be re-issued but found '%s'", reissued.Value)
+	}
+}
+
+func assertTestCookieRejected(t *testing.T, auth string, reissued *http.Cookie) {
+	if auth != "" {
+		t.Errorf("expected cookie to be rejected but found auth '%s'", auth)
+	}
+
+	if reissued != nil {
+		t.Errorf("expected rejected cookie not to be re-issued but found '%s'", reissued.Value)
+	}
+}
+
+func TestJWTValidator_HS256(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	validator := newJWTValidator(testJWTSecret, "testissuer", "testaudience", func() time.Time { return clock })
+
+	valid := jwtClaims{"sub": "testusername", "iss": "testissuer", "aud": "testaudience", "exp": clock.Unix() + 60, "nbf": clock.Unix() - 60}
+
+	tests := []struct {
+		name        string
+		token       string
+		expectValid bool
+	}{
+		{"Valid", signTestJWT(t, "HS256", "", testJWTSecret, valid), true},
+		{"AudienceList", signTestJWT(t, "HS256", "", testJWTSecret, withTestClaim(valid, "aud", []string{"other", "testaudience"})), true},
+		{"NoExpiry", signTestJWT(t, "HS256", "", testJWTSecret, withTestClaim(valid, "exp", nil)), true},
+		{"WrongSecret", signTestJWT(t, "HS256", "", testJWTSecret+"-other", valid), false},
+		{"AlgorithmNone", signTestJWT(t, "none", "", nil, valid), false},
+		{"Expired", signTestJWT(t, "HS256", "", testJWTSecret, withTestClaim(valid, "exp", clock.Unix())), false},
+		{"NotYetValid", signTestJWT(t, "HS256", "", testJWTSecret, withTestClaim(valid, "nbf", clock.Unix()+60)), false},
+		{"WrongIssuer", signTestJWT(t, "HS256", "", testJWTSecret, withTestClaim(valid, "iss", "other")), false},
+		{"MissingIssuer", signTestJWT(t, "HS256", "", testJWTSecret, withTestClaim(valid, "iss", nil)), false},
+		{"WrongAudience", signTestJWT(t, "HS256", "", testJWTSecret, withTestClaim(valid, "aud", []string{"other"})), false},
+		{"RS256WithoutKeys", signTestJWT(t, "RS256", "", testRSAKey(t), valid), false},
+		{"Malformed", "not.a-jwt", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := validator.Validate(test.token)
+			if test.expectValid {
+				if err != nil {
+					t.Fatalf("expected token to be valid but found error: %v", err)
+				}
+
+				if claims["sub"] != "testusername" {
+					t.Errorf("expected 'sub' claim to be 'testusername' but found '%v'", claims["sub"])
+				}
+			} else if err == nil {
+				t.Errorf("expected token to be invalid")
+			}
+		})
+	}
+}
+
+func TestJWTValidator_PublicKeys(t *testing.T) {
+	rsaKey := testRSAKey(t)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherRSAKey := testRSAKey(t)
+
+	jwks, err := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "other", "n": base64.RawURLEncoding.EncodeToString(otherRSAKey.N.Bytes()), "e": "AQAB"},
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()), "e": "AQAB"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": base64.RawURLEncoding.EncodeToString(ecdsaKey.X.FillBytes(make([]byte, 32))), "y": base64.RawURLEncoding.EncodeToString(ecdsaKey.Y.FillBytes(make([]byte, 32)))},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pemKeys []byte
+	for _, key := range []any{&rsaKey.PublicKey, &ecdsaKey.PublicKey} {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pemKeys = append(pemKeys, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	}
+
+	claims := jwtClaims{"sub": "testusername"}
+
+	for name, contents := range map[string][]byte{"JWKS": jwks, "PEM": pemKeys} {
+		t.Run(name, func(t *testing.T) {
+			keys, err := parseJWTKeySet(contents)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			validator := newJWTValidator("", "", "", time.Now)
+			validator.setKeys(keys)
+
+			for _, token := range []string{
+				signTestJWT(t, "RS256", "rsa", rsaKey, claims),
+				signTestJWT(t, "RS256", "", rsaKey, claims),
+				signTestJWT(t, "ES256", "ec", ecdsaKey, claims),
+			} {
+				if _, err := validator.Validate(token); err != nil {
+					t.Errorf("expected token to be valid but found error: %v", err)
+				}
+			}
+
+			for _, token := range []string{
+				signTestJWT(t, "RS256", "rsa", otherRSAKey, claims),
+				signTestJWT(t, "HS256", "", testJWTSecret, claims),
+			} {
+				if _, err := validator.Validate(token); err == nil {
+					t.Errorf("expected token to be invalid")
+				}
+			}
+		})
+	}
+
+	if _, err := parseJWTKeySet([]byte(`{"keys": []}`)); err == nil {
+		t.Errorf("expected a JWKS without keys to be invalid")
+	}
+}
+
+func TestJWTClaims_HeaderValue(t *testing.T) {
+	var claims jwtClaims
+	if err := json.Unmarshal([]byte(`{"sub":"user","groups":["a","b"],"iat":1700000000,"admin":true,"org":{"id":1},"empty":null}`), &claims); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		claim         string
+		expectedValue string
+		expectedOK    bool
+	}{
+		{"sub", "user", true},
+		{"groups", "a,b", true},
+		{"iat", "1700000000", true},
+		{"admin", "true", true},
+		{"org", `{"id":1}`, true},
+		{"empty", "", false},
+		{"missing", "", false},
+	}
+
+	for _, test := range tests {
+		value, ok := claims.headerValue(test.claim)
+		if value != test.expectedValue || ok != test.expectedOK {
+			t.Errorf("expected claim '%s' to be '%s' (%v) but found '%s' (%v)", test.claim, test.expectedValue, test.expectedOK, value, ok)
+		}
+	}
+}
+
+func TestAuthHack_UpstreamUnauthorized(t *testing.T) {
+	tests := []struct {
+		action               string
+		method               string
+		expectedStatusCode   int
+		expectedLocation     string
+		expectedAuthenticate string
+		expectedBody         string
+	}{
+		{UpstreamUnauthorizedPass, http.MethodGet, http.StatusUnauthorized, "", "Basic realm=\"upstream\"", "upstream"},
+		{UpstreamUnauthorizedStrip, http.MethodGet, http.StatusUnauthorized, "", "", "upstream"},
+		{UpstreamUnauthorizedLogin, http.MethodGet, http.StatusFound, "/login?return_to=%2Fpage", "", ""},
+		{UpstreamUnauthorizedLogin, http.MethodPost, http.StatusUnauthorized, "", "Basic realm=\"upstream\"", "upstream"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.action+"_"+test.method, func(t *testing.T) {
+			config := CreateConfig()
+			config.CookieSecret = testCookieSecret
+			config.CookieIdleTimeout = "1h"
+			config.UseSessions = true
+			config.LoginPath = "/login"
+			config.UpstreamUnauthorizedAction = test.action
+
+			p, clock := newTestPlugin(t, config)
+			p.next = http.HandlerFunc(func(responseWriter http.ResponseWriter, _ *http.Request) {
+				responseWriter.Header().Set("WWW-Authenticate", "Basic realm=\"upstream\"")
+				responseWriter.Header().Set("Content-Type", "text/plain")
+				responseWriter.WriteHeader(http.StatusUnauthorized)
+				_, _ = responseWriter.Write([]byte("upstream"))
+			})
+
+			cookie := issueTestCookie(t, p, newCookiePayloadForAuth(t, p, testAuth))
+
+			// The cookie is due to be re-issued, which the expired cookie replaces
+			*clock = clock.Add(45 * time.Minute)
+
+			request, err := http.NewRequest(test.method, "https://localhost/page", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Sec-Fetch-Mode", "navigate")
+			request.AddCookie(cookie)
+
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.expectedStatusCode {
+				t.Errorf("expected status code '%v' but found '%v'", test.expectedStatusCode, recorder.Code)
+			}
+
+			if location := recorder.Header().Get("Location"); location != test.expectedLocation {
+				t.Errorf("expected location '%s' but found '%s'", test.expectedLocation, location)
+			}
+
+			if authenticate := recorder.Header().Get("WWW-Authenticate"); authenticate != test.expectedAuthenticate {
+				t.Errorf("expected WWW-Authenticate header '%s' but found '%s'", test.expectedAuthenticate, authenticate)
+			}
+
+			if body := recorder.Body.String(); body != test.expectedBody {
+				t.Errorf("expected body '%s' but found '%s'", test.expectedBody, body)
+			}
+
+			cookies := recorder.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != config.CookieName || cookies[0].MaxAge >= 0 {
+				t.Errorf("expected only the cookie to be expired but found '%v'", cookies)
+			}
+
+			if p.sessions.Len() != 0 {
+				t.Errorf("expected session to be deleted but found %d sessions", p.sessions.Len())
+			}
+		})
+	}
+}
+
+func TestAuthHack_UpstreamAuthorized(t *testing.T) {
+	config := CreateConfig()
+	config.UpstreamUnauthorizedAction = UpstreamUnauthorizedStrip
+
+	p, _ := newTestPlugin(t, config)
+	p.next = http.HandlerFunc(func(responseWriter http.ResponseWriter, _ *http.Request) {
+		responseWriter.Header().Set("WWW-Authenticate", "Basic realm=\"upstream\"")
+		_, _ = responseWriter.Write([]byte("upstream"))
+	})
+
+	request, err := http.NewRequest(http.MethodGet, "https://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.AddCookie(&http.Cookie{Name: config.CookieName, Value: testAuth.String()})
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "upstream" || recorder.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected upstream response to be passed through but found '%v' '%s'", recorder.Code, recorder.Body.String())
+	}
+
+	if setCookie := recorder.Header().Get("Set-Cookie"); setCookie != "" {
+		t.Errorf("expected no cookie to be set but found '%s'", setCookie)
+	}
+}
+
+func TestAuthHack_MultiCredentialCookie(t *testing.T) {
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.MultiCredentialCookie = true
+	config.CredentialPathPrefixes = []string{"/grafana/"}
+
+	p, _ := newTestPlugin(t, config)
+
+	// serve sends a request to the URL with the cookie, returning the proxied authorization header and the cookie set
+	// on the response, or the cookie sent if none was set
+	serve := func(url string, cookie *http.Cookie) (string, *http.Cookie) {
+		var auth string
+		p.next = http.HandlerFunc(func(_ http.ResponseWriter, request *http.Request) {
+			auth = request.Header.Get(AuthorizationHeader)
+		})
+
+		request, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cookie != nil {
+			request.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, request)
+
+		if cookies := recorder.Result().Cookies(); len(cookies) != 0 {
+			return auth, cookies[0]
+		}
+
+		return auth, cookie
+	}
+
+	_, cookie := serve("https://a.example.com/?username=testusername&password=testpassword", nil)
+	_, cookie = serve("https://B.example.com/?username=upstreamuser&password=upstreampassword", cookie)
+	_, cookie = serve("https://a.example.com/grafana/?username=upstreamuser&password=upstreampassword", cookie)
+
+	tests := []struct {
+		url          string
+		expectedAuth encodedAuthWithoutPrefix
+	}{
+		{"https://a.example.com/", testAuth},
+		{"https://a.example.com/grafana", testUpstreamAuth},
+		{"https://a.example.com/grafana/d/dashboard", testUpstreamAuth},
+		{"https://a.example.com/grafanax", testAuth},
+		{"https://b.example.com:8443/page", testUpstreamAuth},
+		{"https://c.example.com/", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			auth, _ := serve(test.url, cookie)
+
+			var expectedAuth string
+			if test.expectedAuth != "" {
+				expectedAuth = test.expectedAuth.WithPrefix().String()
+			}
+
+			if auth != expectedAuth {
+				t.Errorf("expected auth '%s' but found '%s'", expectedAuth, auth)
+			}
+		})
+	}
+
+	// Replacing one entry leaves the others in place
+	_, cookie = serve("https://b.example.com/?username=testusername&password=testpassword", cookie)
+
+	if auth, _ := serve("https://b.example.com/", cookie); auth != testAuth.WithPrefix().String() {
+		t.Errorf("expected entry to be replaced but found auth '%s'", auth)
+	}
+
+	if auth, _ := serve("https://a.example.com/grafana/", cookie); auth != testUpstreamAuth.WithPrefix().String() {
+		t.Errorf("expected other entries to be kept but found auth '%s'", auth)
+	}
+}
+
+func TestAuthHack_MultiCredentialCookie_UpstreamUnauthorized(t *testing.T) {
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.MultiCredentialCookie = true
+
+	p, _ := newTestPlugin(t, config)
+	p.next = http.HandlerFunc(func(responseWriter http.ResponseWriter, _ *http.Request) {
+		responseWriter.WriteHeader(http.StatusUnauthorized)
+	})
+
+	entries := cookieEntries{"a.example.com": testAuth.String(), "b.example.com": testUpstreamAuth.String()}
+	cookie := issueTestCookie(t, p, newCookiePayload(entries.encode(), p.now()))
+
+	request, err := http.NewRequest(http.MethodGet, "https://a.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.AddCookie(cookie)
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, request)
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge < 0 {
+		t.Fatalf("expected the cookie to be re-issued but found '%v'", cookies)
+	}
+
+	payload, _ := p.decodeCookieValue(cookies[0].Value)
+
+	remaining, err := decodeCookieEntries(payload.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(remaining) != 1 || remaining["b.example.com"] != testUpstreamAuth.String() {
+		t.Errorf("expected only the rejected entry to be removed but found '%v'", remaining)
+	}
+
+	// Once the last entry is rejected, the whole cookie is expired
+	entries = cookieEntries{"a.example.com": testAuth.String()}
+	cookie = issueTestCookie(t, p, newCookiePayload(entries.encode(), p.now()))
+
+	request, err = http.NewRequest(http.MethodGet, "https://a.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.AddCookie(cookie)
+
+	recorder = httptest.NewRecorder()
+	p.ServeHTTP(recorder, request)
+
+	cookies = recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("expected the cookie to be expired but found '%v'", cookies)
+	}
+}
+
+func TestAuthHack_MultiCredentialCookie_RejectsSingleCredentialCookie(t *testing.T) {
+	config := CreateConfig()
+	config.MultiCredentialCookie = true
+
+	p, _ := newTestPlugin(t, config)
+
+	auth, reissued := serveTestCookie(t, p, &http.Cookie{Name: config.CookieName, Value: testAuth.String()})
+	assertTestCookieRejected(t, auth, reissued)
+}
+
+func TestAuthHack_CredentialPathPrefixesRequiresMultiCredentialCookie(t *testing.T) {
+	config := CreateConfig()
+	config.CredentialPathPrefixes = []string{"/grafana"}
+
+	if _, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), config, "test"); err == nil {
+		t.Errorf("expected CredentialPathPrefixes without MultiCredentialCookie to be rejected")
+	}
+
+	config.MultiCredentialCookie = true
+	config.CredentialPathPrefixes = []string{"grafana"}
+
+	if _, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), config, "test"); err == nil {
+		t.Errorf("expected a relative path prefix to be rejected")
+	}
+}
+
+func TestAuthHack_Logout(t *testing.T) {
+	config := CreateConfig()
+	config.UseSessions = true
+	config.CookieDomain = "example.com"
+	config.CookiePath = "/app"
+	config.LogoutPath = "/logout"
+	config.LogoutRedirectURL = "https://example.com/logged-out"
+
+	p, _ := newTestPlugin(t, config)
+
+	current := issueTestCookie(t, p, newCookiePayloadForAuth(t, p, testAuth))
+	other := issueTestCookie(t, p, newCookiePayloadForAuth(t, p, testAuth))
+	otherUser := issueTestCookie(t, p, newCookiePayloadForAuth(t, p, testUpstreamAuth))
+
+	logout := func(cookie *http.Cookie, query string) {
+		request, err := http.NewRequest(http.MethodGet, "https://example.com/logout"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusSeeOther || recorder.Header().Get("Location") != config.LogoutRedirectURL {
+			t.Errorf("expected redirect to '%s' but found '%v' to '%s'", config.LogoutRedirectURL, recorder.Code, recorder.Header().Get("Location"))
+		}
+
+		cookies := recorder.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].MaxAge >= 0 || cookies[0].Domain != config.CookieDomain || cookies[0].Path != config.CookiePath {
+			t.Errorf("expected cookie to be expired but found '%v'", cookies)
+		}
+	}
+
+	logout(current, "")
+
+	auth, _ := serveTestCookie(t, p, current)
+	assertTestCookieRejected(t, auth, nil)
+
+	auth, reissued := serveTestCookie(t, p, other)
+	assertTestCookieAccepted(t, auth, reissued, false)
+
+	// Logging out everywhere revokes the user's other sessions, but not other users'
+	another := issueTestCookie(t, p, newCookiePayloadForAuth(t, p, testAuth))
+
+	logout(another, "?all=1")
+
+	auth, _ = serveTestCookie(t, p, other)
+	assertTestCookieRejected(t, auth, nil)
+
+	if auth, _ := serveTestCookie(t, p, otherUser); auth != testUpstreamAuth.WithPrefix().String() {
+		t.Errorf("expected other user's session to remain but found auth '%s'", auth)
+	}
+
+	// Logging out without a cookie still expires it
+	logout(&http.Cookie{Name: "unrelated", Value: "value"}, "")
+}
+
+func TestAuthHack_Logout_SessionTokens(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte(testUsersFileContents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.UsersFile = usersFile
+	config.SessionTokenSecret = testJWTSecret
+	config.UpstreamCredentials = map[string]string{"testusername": testUpstreamAuth.String()}
+	config.LogoutPath = "/logout"
+
+	p, clock := newTestPlugin(t, config)
+
+	newTokenCookie := func() *http.Cookie {
+		value, err := p.newCookieValue(testAuth, sessionClient{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return issueTestCookie(t, p, newCookiePayload(value, p.now()))
+	}
+
+	current, other := newTokenCookie(), newTokenCookie()
+
+	request, err := http.NewRequest(http.MethodPost, "https://localhost/logout?all=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.AddCookie(&http.Cookie{Name: current.Name, Value: current.Value})
+	p.ServeHTTP(httptest.NewRecorder(), request)
+
+	auth, _ := serveTestCookie(t, p, other)
+	assertTestCookieRejected(t, auth, nil)
+
+	// Tokens issued after logging out are accepted
+	*clock = clock.Add(time.Second)
+
+	if auth, _ := serveTestCookie(t, p, newTokenCookie()); auth != testUpstreamAuth.WithPrefix().String() {
+		t.Errorf("expected new token to be accepted but found auth '%s'", auth)
+	}
+}
+
+func TestAuthHack_Admin(t *testing.T) {
+	config := CreateConfig()
+	config.UseSessions = true
+	config.AdminPath = "/admin"
+	config.AdminToken = "testadmintoken"
+	config.AdminAllowedIPs = []string{"192.0.2.0/24", "2001:db8::1"}
+
+	p, clock := newTestPlugin(t, config)
+
+	login := func(auth encodedAuthWithoutPrefix) *http.Cookie {
+		request, err := http.NewRequest(http.MethodGet, "https://localhost/?authorization="+auth.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.RequestURI = request.URL.String()
+		request.RemoteAddr = "198.51.100.7:1234"
+		request.Header.Set("User-Agent", "testagent")
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, request)
+
+		return recorder.Result().Cookies()[0]
+	}
+
+	admin := func(method, path, token, remoteAddr string) *httptest.ResponseRecorder {
+		request, err := http.NewRequest(method, "https://localhost"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.RemoteAddr = remoteAddr
+		request.Header.Set(AuthorizationHeader, "Bearer "+token)
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, request)
+
+		return recorder
+	}
+
+	first := login(testAuth)
+	*clock = clock.Add(time.Minute)
+	second := login(testAuth)
+	login(testUpstreamAuth)
+
+	if recorder := admin(http.MethodGet, "/admin/sessions", "wrongtoken", "192.0.2.1:1234"); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected invalid token to be unauthorized but found '%v'", recorder.Code)
+	}
+
+	if recorder := admin(http.MethodGet, "/admin/sessions", "testadmintoken", "203.0.113.1:1234"); recorder.Code != http.StatusForbidden {
+		t.Errorf("expected disallowed IP to be forbidden but found '%v'", recorder.Code)
+	}
+
+	recorder := admin(http.MethodGet, "/admin/sessions", "testadmintoken", "[2001:db8::1]:1234")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected sessions to be listed but found '%v'", recorder.Code)
+	}
+
+	var list struct {
+		Sessions []adminSession `json:"sessions"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Sessions) != 3 {
+		t.Fatalf("expected 3 sessions but found %d", len(list.Sessions))
+	}
+
+	listed := list.Sessions[2]
+	if listed.Username != "testusername" || listed.ClientIP != "198.51.100.7" || listed.UserAgent != "testagent" || !listed.CreatedAt.Equal(clock.Add(-time.Minute)) {
+		t.Errorf("expected first session to be listed but found '%+v'", listed)
+	}
+
+	if body := recorder.Body.String(); strings.Contains(body, testAuth.String()) || strings.Contains(body, strings.TrimPrefix(first.Value, sessionCookieValuePrefix)) {
+		t.Errorf("expected session list not to expose credentials or session IDs but found '%s'", body)
+	}
+
+	// Revoking takes effect on the next request
+	if recorder := admin(http.MethodDelete, "/admin/sessions/"+listed.ID, "testadmintoken", "192.0.2.1:1234"); recorder.Code != http.StatusOK {
+		t.Errorf("expected session to be revoked but found '%v'", recorder.Code)
+	}
+
+	auth, _ := serveTestCookie(t, p, first)
+	assertTestCookieRejected(t, auth, nil)
+
+	auth, reissued := serveTestCookie(t, p, second)
+	assertTestCookieAccepted(t, auth, reissued, false)
+
+	if recorder := admin(http.MethodDelete, "/admin/sessions?username=testusername", "testadmintoken", "192.0.2.1:1234"); recorder.Code != http.StatusOK {
+		t.Errorf("expected user's sessions to be revoked but found '%v'", recorder.Code)
+	}
+
+	auth, _ = serveTestCookie(t, p, second)
+	assertTestCookieRejected(t, auth, nil)
+
+	if p.sessions.Len() != 1 {
+		t.Errorf("expected other user's session to remain but found %d sessions", p.sessions.Len())
+	}
+
+	if recorder := admin(http.MethodDelete, "/admin/sessions/unknown", "testadmintoken", "192.0.2.1:1234"); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected unknown session to be not found but found '%v'", recorder.Code)
+	}
+}
+
+func TestAuthHack_Bundle(t *testing.T) {
+	tests := []struct {
+		name         string
+		cookieDomain string
+		// expectedHops are the hosts visited before landing on BundleRedirectURL
+		expectedHops []string
+	}{
+		{"RedirectChain", "", []string{"a.example.com", "b.example.com"}},
+		{"SharedCookie", "example.com", []string{"a.example.com"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := CreateConfig()
+			config.CookieSecret = testCookieSecret
+			config.CookieDomain = test.cookieDomain
+			config.MultiCredentialCookie = true
+			config.CredentialPathPrefixes = []string{"/grafana"}
+			config.AdminPath = "/admin"
+			config.AdminToken = "testadmintoken"
+			config.BundlePath = "/bundle"
+			config.BundleSecret = "testbundlesecret"
+			config.BundleRedirectURL = "https://portal.example.com/"
+
+			p, _ := newTestPlugin(t, config)
+
+			link := createTestBundle(t, p, `{"credentials": [
+				{"host": "A.example.com", "username": "testusername", "password": "testpassword"},
+				{"host": "b.example.com", "authorization": "Basic `+testUpstreamAuth.String()+`"},
+				{"host": "a.example.com/grafana", "authorization": "Basic `+testUpstreamAuth.String()+`"}
+			]}`)
+
+			var cookie *http.Cookie
+			for i, expectedHost := range test.expectedHops {
+				request, err := http.NewRequest(http.MethodGet, link, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if request.Host != expectedHost {
+					t.Fatalf("expected hop %d to be to '%s' but found '%s'", i, expectedHost, request.Host)
+				}
+
+				recorder := httptest.NewRecorder()
+				p.ServeHTTP(recorder, request)
+
+				if recorder.Code != http.StatusFound {
+					t.Fatalf("expected bundle to be accepted on '%s' but found '%v'", expectedHost, recorder.Code)
+				}
+
+				if recorder.Header().Get("Referrer-Policy") != "no-referrer" {
+					t.Errorf("expected the bundle not to be leaked in the referrer")
+				}
+
+				cookies := recorder.Result().Cookies()
+				if len(cookies) != 1 {
+					t.Fatalf("expected a cookie to be set on '%s' but found '%v'", expectedHost, cookies)
+				}
+				cookie = cookies[0]
+
+				link = recorder.Header().Get("Location")
+			}
+
+			if link != config.BundleRedirectURL {
+				t.Errorf("expected to land on '%s' but found '%s'", config.BundleRedirectURL, link)
+			}
+
+			// The last cookie has every entry with a shared cookie, otherwise just those for the last host
+			expected := map[string]encodedAuthWithoutPrefix{"b.example.com": testUpstreamAuth}
+			if test.cookieDomain != "" {
+				expected["a.example.com"] = testAuth
+				expected["a.example.com/grafana"] = testUpstreamAuth
+			}
+
+			payload, _ := p.decodeCookieValue(cookie.Value)
+
+			entries, err := decodeCookieEntries(payload.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(entries) != len(expected) {
+				t.Errorf("expected entries for '%v' but found '%v'", expected, entries)
+			}
+
+			for scope, auth := range expected {
+				if entries[scope] != auth.String() {
+					t.Errorf("expected entry for '%s' to be '%s' but found '%s'", scope, auth, entries[scope])
+				}
+			}
+		})
+	}
+}
+
+func TestAuthHack_Bundle_Rejected(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte(testUsersFileContents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.UsersFile = usersFile
+	config.AdminPath = "/admin"
+	config.AdminToken = "testadmintoken"
+	config.BundlePath = "/bundle"
+	config.BundleSecret = "testbundlesecret"
+	config.BundleLifetime = "1h"
+
+	p, clock := newTestPlugin(t, config)
+
+	link := createTestBundle(t, p, `{"credentials": [{"host": "a.example.com", "username": "testusername", "password": "testpassword"}]}`)
+
+	// The bundle is only valid with the secret it was sealed with
+	other, _ := newTestPlugin(t, config)
+	other.bundleCipher, _ = newCookieCipher([]string{"otherbundlesecret"}, bundleAdditionalData)
+
+	tests := []struct {
+		name    string
+		plugin  *AuthHackPlugin
+		link    string
+		elapsed time.Duration
+	}{
+		{"Tampered", p, strings.Replace(link, "bundle=v3.", "bundle=v3.A", 1), 0},
+		{"OtherSecret", other, link, 0},
+		{"OtherHost", p, strings.Replace(link, "a.example.com", "c.example.com", 1), 0},
+		{"Expired", p, link, time.Hour},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*clock = time.Unix(1700000000, 0).Add(test.elapsed)
+
+			request, err := http.NewRequest(http.MethodGet, test.link, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			test.plugin.ServeHTTP(recorder, request)
+
+			if recorder.Code != http.StatusForbidden {
+				t.Errorf("expected bundle to be rejected but found '%v'", recorder.Code)
+			}
+
+			if setCookie := recorder.Header().Get("Set-Cookie"); setCookie != "" {
+				t.Errorf("expected no cookie to be set but found '%s'", setCookie)
+			}
+		})
+	}
+
+	*clock = time.Unix(1700000000, 0)
+
+	// Bundles can't be created with invalid credentials, or paths that don't have their own entry
+	for _, body := range []string{
+		`{"credentials": [{"host": "a.example.com", "username": "testusername", "password": "wrongpassword"}]}`,
+		`{"credentials": [{"host": "a.example.com/grafana", "username": "testusername", "password": "testpassword"}]}`,
+		`{"credentials": [{"host": "a.example.com:8443", "username": "testusername", "password": "testpassword"}]}`,
+		`{"credentials": [{"host": "a.example.com"}]}`,
+		`{"credentials": []}`,
+	} {
+		request, err := http.NewRequest(http.MethodPost, "https://localhost/admin/bundles", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set(AuthorizationHeader, "Bearer testadmintoken")
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("expected bundle '%s' to be rejected but found '%v'", body, recorder.Code)
+		}
+	}
+}
+
+// createTestBundle creates a bundle through the admin API, returning the link that redeems it.
+func createTestBundle(t *testing.T, p *AuthHackPlugin, body string) string {
+	request, err := http.NewRequest(http.MethodPost, "https://localhost"+p.config.AdminPath+"/bundles", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(AuthorizationHeader, "Bearer "+p.config.AdminToken)
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected bundle to be created but found '%v': %s", recorder.Code, recorder.Body.String())
+	}
+
+	var response struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	return response.URL
+}
+
+func TestAuthHack_AuthLink(t *testing.T) {
+	linksFile := filepath.Join(t.TempDir(), "links")
+	if err := os.WriteFile(linksFile, []byte("# Shared with a friend\nfriend Basic "+testAuth.String()+"\n\nother Bearer testtoken\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.AuthLinksFile = linksFile
+	config.AuthLinkSecret = "testauthlinksecret"
+	config.AdminPath = "/admin"
+	config.AdminToken = "testadmintoken"
+
+	p, clock := newTestPlugin(t, config)
+
+	expiresAt := clock.Add(time.Hour)
+
+	tests := []struct {
+		name         string
+		link         string
+		expectedAuth encodedAuthWithoutPrefix
+	}{
+		{"Valid", newAuthLink(config.AuthLinkSecret, "friend", expiresAt), testAuth},
+		{"Bearer", newAuthLink(config.AuthLinkSecret, "other", expiresAt), "Bearer testtoken"},
+		{"Expired", newAuthLink(config.AuthLinkSecret, "friend", *clock), ""},
+		{"ExtendedExpiry", strings.Replace(newAuthLink(config.AuthLinkSecret, "friend", *clock), fmt.Sprint(clock.Unix()), fmt.Sprint(expiresAt.Unix()), 1), ""},
+		{"OtherSecret", newAuthLink("othersecret", "friend", expiresAt), ""},
+		{"UnknownID", newAuthLink(config.AuthLinkSecret, "unknown", expiresAt), ""},
+		{"Malformed", "friend", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var proxied bool
+			p.next = http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+				proxied = true
+			})
+
+			request, err := http.NewRequest(http.MethodGet, "https://localhost/page?authlink="+test.link+"&other=value", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.RequestURI = request.URL.RequestURI()
+
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, request)
+
+			if test.expectedAuth == "" {
+				if !proxied || recorder.Header().Get("Set-Cookie") != "" {
+					t.Errorf("expected link to be ignored but found '%v' '%s'", recorder.Code, recorder.Header().Get("Set-Cookie"))
+				}
+
+				return
+			}
+
+			if location := recorder.Header().Get("Location"); recorder.Code != http.StatusTemporaryRedirect || !strings.HasSuffix(location, "/page?other=value") {
+				t.Fatalf("expected redirect without the link but found '%v' '%s'", recorder.Code, location)
+			}
+
+			auth, _ := serveTestCookie(t, p, recorder.Result().Cookies()[0])
+			if auth != test.expectedAuth.WithPrefix().String() {
+				t.Errorf("expected cookie with auth '%s' but found '%s'", test.expectedAuth.WithPrefix(), auth)
+			}
+		})
+	}
+
+	// Links created through the admin API are accepted until they expire
+	request, err := http.NewRequest(http.MethodPost, "https://localhost/admin/authlinks", strings.NewReader(`{"id": "friend", "lifetime": "24h"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(AuthorizationHeader, "Bearer testadmintoken")
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, request)
+
+	var response struct {
+		AuthLink  string    `json:"authlink"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if auth, err := p.resolveAuthLink(response.AuthLink); err != nil || auth != testAuth {
+		t.Errorf("expected created link to be accepted but found '%s': %v", auth, err)
+	}
+
+	*clock = response.ExpiresAt
+
+	if _, err := p.resolveAuthLink(response.AuthLink); err == nil {
+		t.Errorf("expected created link to expire at '%v'", response.ExpiresAt)
+	}
+}
+
+func TestParseAuthLinksFile_Invalid(t *testing.T) {
+	for _, contents := range []string{
+		"friend",
+		"friend.name Basic " + testAuth.String(),
+		"friend Basic " + testAuth.String() + "\nfriend Bearer testtoken",
+	} {
+		if _, err := parseAuthLinksFile([]byte(contents)); err == nil {
+			t.Errorf("expected '%s' to be rejected", contents)
+		}
+	}
+}
+
+func TestAuthHack_OneTimeLink(t *testing.T) {
+	linksFile := filepath.Join(t.TempDir(), "links")
+	if err := os.WriteFile(linksFile, []byte("family Basic "+testAuth.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.AuthLinksFile = linksFile
+	config.AuthLinkSecret = "testauthlinksecret"
+	config.AdminPath = "/admin"
+	config.AdminToken = "testadmintoken"
+
+	p, clock := newTestPlugin(t, config)
+
+	serve := func(link string, cookie *http.Cookie) (*httptest.ResponseRecorder, bool) {
+		var proxied bool
+		p.next = http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			proxied = true
+		})
+
+		request, err := http.NewRequest(http.MethodGet, "https://localhost/page?onetime="+link, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cookie != nil {
+			request.AddCookie(cookie)
+		}
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, request)
+
+		return recorder, proxied
+	}
+
+	request, err := http.NewRequest(http.MethodPost, "https://localhost/admin/onetimelinks", strings.NewReader(`{"id": "family", "lifetime": "1h"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(AuthorizationHeader, "Bearer testadmintoken")
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, request)
+
+	var response struct {
+		OneTime string `json:"onetime"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder, _ = serve(response.OneTime, nil)
+	if recorder.Code != http.StatusTemporaryRedirect || strings.Contains(recorder.Header().Get("Location"), "onetime") {
+		t.Fatalf("expected redirect without the link but found '%v' '%s'", recorder.Code, recorder.Header().Get("Location"))
+	}
+
+	cookie := recorder.Result().Cookies()[0]
+	if auth, _ := serveTestCookie(t, p, cookie); auth != testAuth.WithPrefix().String() {
+		t.Errorf("expected cookie with auth '%s' but found '%s'", testAuth.WithPrefix(), auth)
+	}
+
+	// Reusing the link is rejected, even alongside the cookie it set
+	for _, c := range []*http.Cookie{nil, cookie} {
+		recorder, proxied := serve(response.OneTime, c)
+		if recorder.Code != http.StatusGone || proxied || !strings.Contains(recorder.Body.String(), "no longer valid") {
+			t.Errorf("expected reused link to be gone but found '%v'", recorder.Code)
+		}
+	}
+
+	expired, err := newOneTimeLink(config.AuthLinkSecret, "family", *clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if recorder, proxied := serve(expired, nil); recorder.Code != http.StatusGone || proxied {
+		t.Errorf("expected expired link to be gone but found '%v'", recorder.Code)
+	}
+
+	// Links that aren't valid one-time links are ignored, like other invalid credentials
+	for _, link := range []string{
+		newAuthLink(config.AuthLinkSecret, "family", clock.Add(time.Hour)),
+		strings.Replace(response.OneTime, "family", "other", 1),
+	} {
+		if recorder, proxied := serve(link, nil); !proxied || recorder.Header().Get("Set-Cookie") != "" {
+			t.Errorf("expected link '%s' to be ignored but found '%v'", link, recorder.Code)
+		}
+	}
+}
+
+func TestAuthHack_OneTimeLink_LedgerUnavailable(t *testing.T) {
+	dir := t.TempDir()
+	linksFile := filepath.Join(dir, "links")
+	if err := os.WriteFile(linksFile, []byte("family Basic "+testAuth.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.AuthLinksFile = linksFile
+	config.AuthLinkSecret = "testauthlinksecret"
+	config.OneTimeLedgerFile = filepath.Join(dir, "ledger.json")
+
+	p, clock := newTestPlugin(t, config)
+
+	link, err := newOneTimeLink(config.AuthLinkSecret, "family", clock.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func() *httptest.ResponseRecorder {
+		request, err := http.NewRequest(http.MethodGet, "https://localhost/page?onetime="+link, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, request)
+
+		return recorder
+	}
+
+	// The ledger can't be written, so the link would be reusable after a restart
+	p.oneTimeLedger.path = filepath.Join(dir, "missing", "ledger.json")
+
+	if recorder := serve(); recorder.Code != http.StatusInternalServerError || recorder.Header().Get("Set-Cookie") != "" {
+		t.Errorf("expected link to be refused but found '%v' '%s'", recorder.Code, recorder.Header().Get("Set-Cookie"))
+	}
+
+	// The link wasn't used, so it still works once the ledger can be written
+	p.oneTimeLedger.path = config.OneTimeLedgerFile
+
+	if recorder := serve(); recorder.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected link to be accepted but found '%v'", recorder.Code)
+	}
+}
+
+func TestOneTimeLedger_Concurrent(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	ledger := newOneTimeLedger("", func() time.Time { return clock })
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	consumed := 0
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ok, err := ledger.Consume("link", clock.Add(time.Hour))
+			if err != nil {
+				t.Error(err)
+			}
+
+			if ok {
+				mutex.Lock()
+				consumed++
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if consumed != 1 {
+		t.Errorf("expected the link to be consumed once but found %d", consumed)
+	}
+}
+
+func TestOneTimeLedger_Persisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+
+	clock := time.Unix(1700000000, 0)
+	now := func() time.Time { return clock }
+
+	ledger := newOneTimeLedger(path, now)
+	if err := ledger.Load(); err != nil {
+		t.Fatalf("expected missing ledger to be ignored but found: %v", err)
+	}
+
+	if ok, err := ledger.Consume("first", clock.Add(time.Minute)); !ok || err != nil {
+		t.Fatalf("expected link to be consumed but found '%v': %v", ok, err)
+	}
+	if ok, err := ledger.Consume("second", clock.Add(time.Hour)); !ok || err != nil {
+		t.Fatalf("expected link to be consumed but found '%v': %v", ok, err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(contents), "first") {
+		t.Errorf("expected the ledger to only hold hashes of links but found '%s'", contents)
+	}
+
+	// Links used before a restart stay used, until they expire
+	clock = clock.Add(time.Minute)
+
+	restarted := newOneTimeLedger(path, now)
+	if err := restarted.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if restarted.Len() != 1 {
+		t.Errorf("expected the expired link to be pruned but found %d links", restarted.Len())
+	}
+
+	if ok, _ := restarted.Consume("second", clock.Add(time.Hour)); ok {
+		t.Errorf("expected link used before the restart to be rejected")
+	}
+
+	if err := os.WriteFile(path, []byte("corrupt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := newOneTimeLedger(path, now).Load(); err == nil {
+		t.Errorf("expected corrupt ledger to be rejected")
+	}
+}
+
+func TestTOTPSecret_Code(t *testing.T) {
+	// Test vectors from RFC 6238 appendix B at T = 59, truncated to 6 digits
+	tests := []struct {
+		name     string
+		secret   string
+		expected string
+	}{
+		{"SHA1", base32.StdEncoding.EncodeToString([]byte("12345678901234567890")), "287082"},
+		{"SHA256", "sha256:" + base32.StdEncoding.EncodeToString([]byte("12345678901234567890123456789012")), "119246"},
+		{"Lowercase", strings.ToLower(strings.TrimRight(base32.StdEncoding.EncodeToString([]byte("12345678901234567890")), "=")), "287082"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secret, err := parseTOTPSecret(test.secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if code := secret.Code(59 / 30); code != test.expected {
+				t.Errorf("expected '%s' but found '%s'", test.expected, code)
+			}
+		})
+	}
+
+	for _, invalid := range []string{"", "md5:GEZDGNBV", "not base32!"} {
+		if _, err := parseTOTPSecret(invalid); err == nil {
+			t.Errorf("expected '%s' to be rejected", invalid)
+		}
+	}
+}
+
+func TestTOTPVerifier(t *testing.T) {
+	secret, err := parseTOTPSecret("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := time.Unix(1700000000, 0)
+	verifier := newTOTPVerifier(1, func() time.Time { return clock })
+
+	counter := uint64(clock.Unix() / 30)
+
+	if verifier.Verify("user", secret, secret.Code(counter-2)) || verifier.Verify("user", secret, secret.Code(counter+2)) {
+		t.Error("expected codes outside the skew to be rejected")
+	}
+
+	if !verifier.Verify("user", secret, secret.Code(counter-1)) {
+		t.Error("expected code within the skew to be accepted")
+	}
+
+	if verifier.Verify("user", secret, secret.Code(counter-1)) {
+		t.Error("expected reused code to be rejected")
+	}
+
+	if !verifier.Verify("other", secret, secret.Code(counter-1)) {
+		t.Error("expected code to be accepted for another user")
+	}
+
+	// Once the code can no longer be accepted, it's forgotten
+	clock = clock.Add(2 * totpPeriod)
+	if verifier.Verify("user", secret, secret.Code(counter-1)) || len(verifier.used) != 0 {
+		t.Errorf("expected expired code to be rejected and forgotten but found %d used", len(verifier.used))
+	}
+}
+
+func TestAuthHack_Otp(t *testing.T) {
+	const totpSecretValue = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	usersFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte(testUsersFileContents+":"+totpSecretValue+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	linksFile := filepath.Join(t.TempDir(), "links")
+	if err := os.WriteFile(linksFile, []byte("friend Basic "+testAuth.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.UsersFile = usersFile
+	config.OtpQueryParam = "otp"
+	config.AuthLinksFile = linksFile
+	config.AuthLinkSecret = "testauthlinksecret"
+
+	p, clock := newTestPlugin(t, config)
+
+	secret, err := parseTOTPSecret(totpSecretValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := secret.Code(uint64(clock.Unix() / 30))
+
+	serve := func(query string, header string) *httptest.ResponseRecorder {
+		request, err := http.NewRequest(http.MethodGet, "https://localhost/page?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.RequestURI = request.URL.RequestURI()
+
+		if header != "" {
+			request.Header.Set("Authorization", header)
+		}
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, request)
+
+		return recorder
+	}
+
+	if recorder := serve("authorization="+testAuth.String(), ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected missing code to be rejected but found %v", recorder.Code)
+	}
+
+	if recorder := serve("authorization="+testAuth.String()+"&otp=000000", ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected wrong code to be rejected but found %v", recorder.Code)
+	}
+
+	if recorder := serve("", "Basic "+testAuth.String()); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected header without a code to be rejected but found %v", recorder.Code)
+	}
+
+	// A cookie holding the bare credentials isn't one the plugin set, so it can't skip the code either
+	forged, err := http.NewRequest(http.MethodGet, "https://localhost/page", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.AddCookie(&http.Cookie{Name: config.CookieName, Value: testAuth.String()})
+
+	forgedRecorder := httptest.NewRecorder()
+	p.ServeHTTP(forgedRecorder, forged)
+	if forgedRecorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected forged cookie to be rejected but found %v", forgedRecorder.Code)
+	}
+
+	recorder := serve("authorization="+testAuth.String()+"&otp="+code+"&other=value", "")
+	if location := recorder.Header().Get("Location"); recorder.Code != http.StatusTemporaryRedirect || !strings.HasSuffix(location, "/page?other=value") {
+		t.Fatalf("expected redirect without the code but found '%v' '%s'", recorder.Code, location)
+	}
+
+	if recorder := serve("authorization="+testAuth.String()+"&otp="+code, ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected reused code to be rejected but found %v", recorder.Code)
+	}
+
+	// Links are provisioned by the operator, so they don't need a code
+	link := newAuthLink(config.AuthLinkSecret, "friend", clock.Add(time.Hour))
+	if recorder := serve("authlink="+link, ""); recorder.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected link to be accepted without a code but found %v", recorder.Code)
+	}
+}
+
+func TestAuthHack_OtpRequiresUsersFile(t *testing.T) {
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.OtpQueryParam = "otp"
+
+	if _, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), config, "test"); err == nil {
+		t.Error("expected OtpQueryParam without UsersFile to be rejected")
+	}
+}
+
+func TestAuthHack_OtpRequiresProtectedCookie(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte(testUsersFileContents+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a cookie secret, sessions or tokens, the cookie holds the credentials and could be forged
+	config := CreateConfig()
+	config.UsersFile = usersFile
+	config.OtpQueryParam = "otp"
+
+	if _, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), config, "test"); err == nil {
+		t.Error("expected OtpQueryParam with a plain cookie to be rejected")
+	}
+
+	config.UseSessions = true
+
+	if _, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), config, "test"); err != nil {
+		t.Errorf("expected OtpQueryParam with UseSessions to be accepted but found: %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	limiter := newRateLimiter(2, 10*time.Second, 3, time.Minute, 2, func() time.Time { return clock })
+
+	// The bucket holds burst attempts and gains one every interval
+	for i := 0; i < 2; i++ {
+		if wait := limiter.Allow(true, "ip:a"); wait != 0 {
+			t.Fatalf("expected attempt %d to be allowed but found wait %v", i, wait)
+		}
+	}
+
+	if wait := limiter.Allow(true, "ip:a"); wait != 10*time.Second {
+		t.Errorf("expected to wait 10s but found %v", wait)
+	}
+
+	if wait := limiter.Allow(false, "ip:a"); wait != 0 {
+		t.Errorf("expected only lockouts to apply without taking a token but found wait %v", wait)
+	}
+
+	clock = clock.Add(5 * time.Second)
+	if wait := limiter.Allow(true, "ip:a"); wait != 5*time.Second {
+		t.Errorf("expected to wait 5s but found %v", wait)
+	}
+
+	clock = clock.Add(5 * time.Second)
+	if wait := limiter.Allow(true, "ip:a"); wait != 0 {
+		t.Errorf("expected refilled attempt to be allowed but found wait %v", wait)
+	}
+
+	// Lockouts start at the threshold and double with each further failure
+	for i := 0; i < 3; i++ {
+		limiter.Fail("user:a")
+	}
+
+	if wait := limiter.Allow(false, "ip:b", "user:a"); wait != time.Minute {
+		t.Errorf("expected lockout of 1m but found %v", wait)
+	}
+
+	limiter.Fail("user:a")
+	if wait := limiter.Allow(false, "user:a"); wait != 2*time.Minute {
+		t.Errorf("expected lockout of 2m but found %v", wait)
+	}
+
+	for i := 0; i < 20; i++ {
+		limiter.Fail("user:a")
+	}
+
+	if wait := limiter.Allow(false, "user:a"); wait != time.Minute<<lockoutMaxDoublings {
+		t.Errorf("expected lockout to be capped but found %v", wait)
+	}
+
+	limiter.Succeed("user:a")
+	if wait := limiter.Allow(false, "user:a"); wait != 0 {
+		t.Errorf("expected success to end the lockout but found wait %v", wait)
+	}
+
+	// The least recently used key is forgotten
+	limiter.Allow(true, "ip:c")
+	if limiter.Len() != 2 {
+		t.Errorf("expected 2 keys but found %d", limiter.Len())
+	}
+}
+
+func TestAuthHack_RateLimit(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte(testUsersFileContents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.UsersFile = usersFile
+	config.RateLimitBurst = 3
+	config.LockoutThreshold = 2
+
+	p, clock := newTestPlugin(t, config)
+
+	serve := func(auth encodedAuthWithoutPrefix, remoteAddr string) *httptest.ResponseRecorder {
+		request, err := http.NewRequest(http.MethodGet, "https://localhost/?authorization="+auth.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.RequestURI = request.URL.String()
+		request.RemoteAddr = remoteAddr
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, request)
+
+		return recorder
+	}
+
+	wrongAuth := encodeAuthWithoutPrefix("testusername", "wrongpassword")
+
+	for i := 0; i < 2; i++ {
+		if recorder := serve(wrongAuth, "192.0.2.1:1234"); recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("expected invalid credentials to be rejected but found %v", recorder.Code)
+		}
+	}
+
+	// The user is locked out, even from another client
+	recorder := serve(testAuth, "192.0.2.2:1234")
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected lockout but found '%v' '%s'", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+
+	*clock = clock.Add(time.Minute)
+
+	if recorder := serve(testAuth, "192.0.2.2:1234"); recorder.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected valid credentials to be accepted after the lockout but found %v", recorder.Code)
+	}
+
+	// Valid credentials count towards the rate limit too
+	*clock = clock.Add(10 * time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if recorder := serve(testAuth, "192.0.2.3:1234"); recorder.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("expected attempt %d to be accepted but found %v", i, recorder.Code)
+		}
+	}
+
+	recorder = serve(testAuth, "192.0.2.3:1234")
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "10" {
+		t.Errorf("expected rate limit but found '%v' '%s'", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+}
+
+func TestAuthHack_RateLimit_Cookie(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte(testUsersFileContents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a cookie secret, the cookie can be set to any credentials to guess passwords
+	config := CreateConfig()
+	config.UsersFile = usersFile
+	config.RateLimitBurst = 1
+	config.LockoutThreshold = 2
+
+	p, _ := newTestPlugin(t, config)
+
+	serve := func(auth encodedAuthWithoutPrefix) int {
+		request, err := http.NewRequest(http.MethodGet, "https://localhost/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.AddCookie(&http.Cookie{Name: config.CookieName, Value: auth.String()})
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, request)
+
+		return recorder.Code
+	}
+
+	wrongAuth := encodeAuthWithoutPrefix("testusername", "wrongpassword")
+
+	for i := 0; i < 2; i++ {
+		if code := serve(wrongAuth); code != http.StatusUnauthorized {
+			t.Fatalf("expected invalid credentials to be rejected but found %v", code)
+		}
+	}
+
+	if code := serve(wrongAuth); code != http.StatusTooManyRequests {
+		t.Errorf("expected guesses from the cookie to lock out the client but found %v", code)
+	}
+
+	if code := serve(testAuth); code != http.StatusTooManyRequests {
+		t.Errorf("expected valid credentials to be rejected during the lockout but found %v", code)
+	}
+}
+
+func TestAuthHack_RateLimit_SealedCookie(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte(testUsersFileContents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.UsersFile = usersFile
+	config.LockoutThreshold = 2
+
+	p, _ := newTestPlugin(t, config)
+
+	cookie := issueTestCookie(t, p, newCookiePayloadForAuth(t, p, testAuth))
+
+	// Another client locks out the user with wrong passwords
+	wrongAuth := encodeAuthWithoutPrefix("testusername", "wrongpassword")
+	for i := 0; i < 2; i++ {
+		request, err := http.NewRequest(http.MethodGet, "https://localhost/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.RemoteAddr = "203.0.113.9:1234"
+		request.Header.Set(AuthorizationHeader, wrongAuth.WithPrefix().String())
+
+		p.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	// A sealed cookie can't be used to guess passwords, so the user's existing logins keep working
+	request, err := http.NewRequest(http.MethodGet, "https://localhost/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.RemoteAddr = "10.1.1.1:1234"
+	request.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected sealed cookie to be accepted during the lockout but found %v", recorder.Code)
+	}
+}
+
+func TestAuthHack_RateLimit_UpstreamUnauthorized(t *testing.T) {
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.LockoutThreshold = 1
+
+	p, _ := newTestPlugin(t, config)
+	p.next = http.HandlerFunc(func(responseWriter http.ResponseWriter, _ *http.Request) {
+		responseWriter.WriteHeader(http.StatusUnauthorized)
+	})
+
+	cookie := issueTestCookie(t, p, newCookiePayloadForAuth(t, p, testAuth))
+
+	request, err := http.NewRequest(http.MethodGet, "https://localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	p.ServeHTTP(httptest.NewRecorder(), request)
+
+	request, err = http.NewRequest(http.MethodGet, "https://localhost/?authorization="+testAuth.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.RequestURI = request.URL.String()
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("expected credentials rejected downstream to lock out the client but found %v", recorder.Code)
+	}
+}
+
+func TestAuthHack_QueryAuthIPs(t *testing.T) {
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.QueryAuthAllowedIPs = []string{"10.0.0.0/8"}
+	config.QueryAuthDeniedIPs = []string{"10.0.0.66"}
+
+	p, _ := newTestPlugin(t, config)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		allowed    bool
+	}{
+		{"Allowed", "10.0.0.1:1234", true},
+		{"NotAllowed", "192.0.2.1:1234", false},
+		{"Denied", "10.0.0.66:1234", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var proxiedAuth, proxiedURI string
+			p.next = http.HandlerFunc(func(_ http.ResponseWriter, request *http.Request) {
+				proxiedAuth = request.Header.Get(AuthorizationHeader)
+				proxiedURI = request.RequestURI
+			})
+
+			request, err := http.NewRequest(http.MethodGet, "https://localhost/page?authorization="+testAuth.String()+"&other=value", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.RequestURI = request.URL.RequestURI()
+			request.RemoteAddr = test.remoteAddr
+
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, request)
+
+			if test.allowed {
+				if recorder.Code != http.StatusTemporaryRedirect || len(recorder.Result().Cookies()) != 1 {
+					t.Errorf("expected credentials to be used but found %v", recorder.Code)
+				}
+
+				return
+			}
+
+			if recorder.Code != http.StatusOK || len(recorder.Result().Cookies()) != 0 {
+				t.Errorf("expected credentials to be ignored but found %v", recorder.Code)
+			}
+
+			if proxiedAuth != "" || strings.Contains(proxiedURI, testAuth.String()) {
+				t.Errorf("expected credentials to be scrubbed but found '%s' '%s'", proxiedAuth, proxiedURI)
+			}
+		})
+	}
+
+	// Existing logins keep working
+	auth, _ := serveTestCookie(t, p, issueTestCookie(t, p, newCookiePayloadForAuth(t, p, testAuth)))
+	if auth != testAuth.WithPrefix().String() {
+		t.Errorf("expected cookie to be used from any IP but found '%s'", auth)
+	}
+
+	p.config.QueryAuthDeniedAction = QueryAuthDeniedReject
+
+	request, err := http.NewRequest(http.MethodGet, "https://localhost/page?username=testusername&password=testpassword", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.RequestURI = request.URL.RequestURI()
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected credentials to be rejected but found %v", recorder.Code)
+	}
+}
+
+func TestAuthHack_QueryAuthIPs_OneTimeLink(t *testing.T) {
+	linksFile := filepath.Join(t.TempDir(), "links")
+	if err := os.WriteFile(linksFile, []byte("friend Basic "+testAuth.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.AuthLinksFile = linksFile
+	config.AuthLinkSecret = "testauthlinksecret"
+	config.QueryAuthAllowedIPs = []string{"10.0.0.0/8"}
+
+	p, clock := newTestPlugin(t, config)
+
+	link, err := newOneTimeLink(config.AuthLinkSecret, "friend", clock.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(remoteAddr string) int {
+		request, err := http.NewRequest(http.MethodGet, "https://localhost/page?onetime="+link, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.RequestURI = request.URL.RequestURI()
+		request.RemoteAddr = remoteAddr
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, request)
+
+		return recorder.Code
+	}
+
+	// A client that can't use the link doesn't use it up
+	if code := serve("192.0.2.1:1234"); code != http.StatusOK {
+		t.Errorf("expected link to be ignored but found %v", code)
+	}
+
+	if code := serve("10.0.0.1:1234"); code != http.StatusTemporaryRedirect {
+		t.Errorf("expected link to be used but found %v", code)
+	}
+}
+
+func TestAuthHack_QueryAuthIPs_Bundle(t *testing.T) {
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.AdminPath = "/admin"
+	config.AdminToken = "testadmintoken"
+	config.BundlePath = "/bundle"
+	config.BundleSecret = "testbundlesecret"
+	config.BundleRedirectURL = "https://portal.example.com/"
+	config.QueryAuthAllowedIPs = []string{"10.0.0.0/8"}
+
+	p, _ := newTestPlugin(t, config)
+
+	link := createTestBundle(t, p, `{"credentials": [{"host": "a.example.com", "username": "testusername", "password": "testpassword"}]}`)
+
+	tests := []struct {
+		name               string
+		remoteAddr         string
+		action             string
+		expectedStatusCode int
+		expectedCookie     bool
+	}{
+		{"Allowed", "10.0.0.1:1234", QueryAuthDeniedReject, http.StatusFound, true},
+		{"Ignored", "192.0.2.1:1234", QueryAuthDeniedIgnore, http.StatusFound, false},
+		{"Rejected", "192.0.2.1:1234", QueryAuthDeniedReject, http.StatusForbidden, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p.config.QueryAuthDeniedAction = test.action
+
+			request, err := http.NewRequest(http.MethodGet, link, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.RemoteAddr = test.remoteAddr
+
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.expectedStatusCode {
+				t.Errorf("expected status code '%v' but found '%v'", test.expectedStatusCode, recorder.Code)
+			}
+
+			if cookie := len(recorder.Result().Cookies()) != 0; cookie != test.expectedCookie {
+				t.Errorf("expected cookie to be set to be '%v' but found '%v'", test.expectedCookie, cookie)
+			}
+		})
+	}
+}
+
+func TestIPList(t *testing.T) {
+	list, err := parseIPList("test", []string{"192.0.2.0/24", "198.51.100.7", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, expected := range map[string]bool{
+		"192.0.2.200":  true,
+		"198.51.100.7": true,
+		"198.51.100.8": false,
+		"2001:db8::5":  true,
+		"2001:db9::5":  false,
+		"invalid":      false,
+	} {
+		if actual := list.Contains(ip); actual != expected {
+			t.Errorf("expected '%s' to be contained (%v) but found %v", ip, expected, actual)
+		}
+	}
+
+	if _, err := parseIPList("test", []string{"not-an-ip"}); err == nil {
+		t.Errorf("expected invalid entry to be rejected")
+	}
+}
+
+func TestClientIPResolver(t *testing.T) {
+	trustedProxies, err := parseIPList("test", []string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		values     []string
+		expected   string
+	}{
+		{"Direct", XForwardedForHeader, "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"DirectIgnoresHeader", XForwardedForHeader, "192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"Proxied", XForwardedForHeader, "10.0.0.1:1234", []string{"192.0.2.1"}, "192.0.2.1"},
+		{"ProxiedWithoutHeader", XForwardedForHeader, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"SeveralProxies", XForwardedForHeader, "10.0.0.1:1234", []string{"192.0.2.1, 10.0.0.2", "10.0.0.3"}, "192.0.2.1"},
+		{"SpoofedLeftmost", XForwardedForHeader, "10.0.0.1:1234", []string{"198.51.100.1, 192.0.2.1"}, "192.0.2.1"},
+		{"SpoofedTrustedProxy", XForwardedForHeader, "10.0.0.1:1234", []string{"10.0.0.9, 192.0.2.1"}, "192.0.2.1"},
+		{"SpoofedGarbage", XForwardedForHeader, "10.0.0.1:1234", []string{"<script>"}, "10.0.0.1"},
+		{"Port", XForwardedForHeader, "10.0.0.1:1234", []string{"192.0.2.1:5678"}, "192.0.2.1"},
+		{"IPv6", XForwardedForHeader, "[2001:db8::1]:1234", []string{"2001:0db8:0000::5, 2001:db9::5"}, "2001:db9::5"},
+		{"Forwarded", ForwardedHeader, "10.0.0.1:1234", []string{`for=192.0.2.1;proto=https, for="[2001:db8::2]:4711"`}, "192.0.2.1"},
+		{"ForwardedIPv6", ForwardedHeader, "10.0.0.1:1234", []string{`for="[2001:db9::2]:4711";by=10.0.0.1`}, "2001:db9::2"},
+		{"ForwardedQuotedSeparators", ForwardedHeader, "10.0.0.1:1234", []string{`for=198.51.100.1, for=192.0.2.1;host="a,b;for=10.0.0.2"`}, "192.0.2.1"},
+		{"ForwardedObfuscated", ForwardedHeader, "10.0.0.1:1234", []string{`for=192.0.2.1, for=_hidden`}, "10.0.0.1"},
+		{"ForwardedMissingFor", ForwardedHeader, "10.0.0.1:1234", []string{`for=192.0.2.1, proto=https`}, "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodGet, "https://localhost", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.RemoteAddr = test.remoteAddr
+
+			for _, value := range test.values {
+				request.Header.Add(test.header, value)
+			}
+
+			// The client could also send the header the proxies don't use, which must be ignored
+			if test.header == ForwardedHeader {
+				request.Header.Set(XForwardedForHeader, "198.51.100.1")
+			} else {
+				request.Header.Set(ForwardedHeader, "for=198.51.100.1")
+			}
+
+			resolver := clientIPResolver{trustedProxies: trustedProxies, header: test.header}
+
+			if actual := resolver.Resolve(request); actual != test.expected {
+				t.Errorf("expected '%s' but found '%s'", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestAuthHack_TrustedProxyHeader(t *testing.T) {
+	config := CreateConfig()
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	config.TrustedProxyHeader = "forwarded"
+
+	p, _ := newTestPlugin(t, config)
+	if p.clientIPResolver.header != ForwardedHeader {
+		t.Errorf("expected header to be canonicalized but found '%s'", p.clientIPResolver.header)
+	}
+
+	config.TrustedProxyHeader = "X-Real-IP"
+
+	if _, err := New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), config, "test"); err == nil {
+		t.Errorf("expected unsupported TrustedProxyHeader to be rejected")
+	}
+}
+
+func TestAuthHack_JWTCookie(t *testing.T) {
+	config := CreateConfig()
+	config.CookieSecret = testCookieSecret
+	config.JWTSecret = testJWTSecret
+
+	p, clock := newTestPlugin(t, config)
+
+	auth := newEncodedAuthWithoutPrefix(bearerPrefix + signTestJWT(t, "HS256", "", testJWTSecret, jwtClaims{"exp": clock.Unix() + 60}))
+	cookie := issueTestCookie(t, p, newCookiePayload(auth.String(), p.now()))
+
+	proxied, reissued := serveTestCookie(t, p, cookie)
+	if proxied != auth.String() {
+		t.Errorf("expected token to be proxied but found auth '%s'", proxied)
+	}
+
+	if reissued != nil {
+		t.Errorf("expected cookie not to be re-issued but found '%s'", reissued.Value)
+	}
+
+	// Once the token expires, the cookie is cleared
+	*clock = clock.Add(time.Minute)
+
+	proxied, cleared := serveTestCookie(t, p, cookie)
+	if proxied != "" {
+		t.Errorf("expected expired token to be rejected but found auth '%s'", proxied)
+	}
+
+	if cleared == nil || cleared.MaxAge >= 0 {
+		t.Errorf("expected cookie to be cleared but found '%v'", cleared)
+	}
+}
+
+func TestAuthHack_JWTRequiresKey(t *testing.T) {
+	config := CreateConfig()
+	config.JWTIssuer = "testissuer"
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+		t.Errorf("expected JWTIssuer without JWTSecret or JWTKeysFile to be rejected")
+	}
+}
+
+// signTestJWT signs the claims with the algorithm's key, which is a secret string, *rsa.PrivateKey or
+// *ecdsa.PrivateKey. Claims with a nil value are omitted.
+func signTestJWT(t *testing.T, algorithm, keyID string, key any, claims jwtClaims) string {
+	header := map[string]string{"alg": algorithm, "typ": "JWT"}
+	if keyID != "" {
+		header["kid"] = keyID
+	}
+
+	payload := jwtClaims{}
+	for name, value := range claims {
+		if value != nil {
+			payload[name] = value
+		}
+	}
+
+	encode := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	signed := encode(header) + "." + encode(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case string:
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func withTestClaim(claims jwtClaims, name string, value any) jwtClaims {
+	result := jwtClaims{}
+	for n, v := range claims {
+		result[n] = v
+	}
+	result[name] = value
+
+	return result
+}
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
@@ -2,15 +2,24 @@ package traefik_authhack_test
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/JacobSnyder/traefik-authhack"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const DefaultAuthorizationQueryParam = "authorization"
@@ -24,6 +33,19 @@ const TestPassword = "testpassword"
 const TestUsernameEncodedWithoutPrefix = "dGVzdHVzZXJuYW1lOg=="
 const TestUsernameAndPasswordEncodedWithoutPrefix = "dGVzdHVzZXJuYW1lOnRlc3RwYXNzd29yZA=="
 const TestUsernameAndPasswordEncodedWithPrefix = "Basic dGVzdHVzZXJuYW1lOnRlc3RwYXNzd29yZA=="
+const TestCookieSecret = "testcookiesecret"
+const TestAccessTokenQueryParam = "access_token"
+const TestAccessToken = "dGVzdHRva2Vu.dGVzdA-_~+/="
+const TestBearerAuth = "Bearer " + TestAccessToken
+const TestJWTSecret = "testjwtsecret"
+const TestLoginPath = "/.authhack/login"
+
+// TestUsersFileContents has TestUsername with TestPassword (apr1) and other users with each supported hash
+const TestUsersFileContents = `# comment
+testusername:$apr1$abcdefgh$idb/QWG.ElA4XFg88Le/A/
+sha1user:{SHA}i7YRj4/Wk1rQh2o740pxfTJwj/0=
+md5user:$1$abcdefgh$H6JMmWFBXCyBkxzBuU/es0
+`
 
 // TODO:
 // [ ] Auth Header with auth query param should send scrubbed request using auth header
@@ -178,6 +200,751 @@ func TestAuthHack_ServeHTTP_AuthCookie(t *testing.T) {
 	assertProxiedDefaultAuth(t, request, response, config)
 }
 
+func TestAuthHack_ServeHTTP_EncryptedCookie(t *testing.T) {
+	config := createTestConfig()
+	config.CookieSecret = TestCookieSecret
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(DefaultAuthorizationQueryParam, TestUsernameAndPasswordEncodedWithoutPrefix)
+		request.URL.RawQuery = query.Encode()
+	})
+
+	cookie := assertRedirectedWithCookie(t, request, response, config)
+	if cookie == nil {
+		return
+	}
+
+	if strings.Contains(cookie.Value, TestUsernameAndPasswordEncodedWithoutPrefix) {
+		t.Errorf("expected cookie value to be encrypted but found '%s'", cookie.Value)
+	}
+
+	if !strings.HasPrefix(cookie.Value, "v3.") {
+		t.Errorf("expected cookie value to be versioned but found '%s'", cookie.Value)
+	}
+
+	request, response = serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(cookie)
+	})
+
+	assertProxiedDefaultAuth(t, request, response, config)
+
+	if setCookie := response.Header().Get("Set-Cookie"); setCookie != "" {
+		t.Errorf("expected current cookie not to be re-issued but found '%s'", setCookie)
+	}
+}
+
+func TestAuthHack_ServeHTTP_EncryptedCookie_Tampered(t *testing.T) {
+	config := createTestConfig()
+	config.CookieSecret = TestCookieSecret
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(DefaultAuthorizationQueryParam, TestUsernameAndPasswordEncodedWithoutPrefix)
+		request.URL.RawQuery = query.Encode()
+	})
+
+	cookie := assertRedirectedWithCookie(t, request, response, config)
+	if cookie == nil {
+		return
+	}
+
+	// Flip a character in the middle of the sealed value
+	tampered := []byte(cookie.Value)
+	if tampered[len(tampered)/2] == 'A' {
+		tampered[len(tampered)/2] = 'B'
+	} else {
+		tampered[len(tampered)/2] = 'A'
+	}
+
+	request, response = serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: string(tampered)})
+	})
+
+	assertProxied(t, request, response, config, "")
+}
+
+func TestAuthHack_ServeHTTP_EncryptedCookie_Plaintext(t *testing.T) {
+	config := createTestConfig()
+	config.CookieSecret = TestCookieSecret
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: TestUsernameAndPasswordEncodedWithoutPrefix})
+	})
+
+	assertProxied(t, request, response, config, "")
+}
+
+func TestAuthHack_ServeHTTP_EncryptedCookie_DifferentSecret(t *testing.T) {
+	config := createTestConfig()
+	config.CookieSecret = TestCookieSecret
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(DefaultAuthorizationQueryParam, TestUsernameAndPasswordEncodedWithoutPrefix)
+		request.URL.RawQuery = query.Encode()
+	})
+
+	cookie := assertRedirectedWithCookie(t, request, response, config)
+	if cookie == nil {
+		return
+	}
+
+	config.CookieSecret = TestCookieSecret + "-other"
+
+	request, response = serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(cookie)
+	})
+
+	assertProxied(t, request, response, config, "")
+}
+
+func TestAuthHack_ServeHTTP_EncryptedCookie_RotatedSecret(t *testing.T) {
+	const testNewCookieSecret = TestCookieSecret + "-new"
+
+	config := createTestConfig()
+	config.CookieSecrets = []string{TestCookieSecret}
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(DefaultAuthorizationQueryParam, TestUsernameAndPasswordEncodedWithoutPrefix)
+		request.URL.RawQuery = query.Encode()
+	})
+
+	oldCookie := assertRedirectedWithCookie(t, request, response, config)
+	if oldCookie == nil {
+		return
+	}
+
+	// Rotate in a new secret, keeping the old one so existing cookies are still accepted
+	config.CookieSecrets = []string{testNewCookieSecret, TestCookieSecret}
+
+	request, response = serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(oldCookie)
+	})
+
+	assertProxiedDefaultAuth(t, request, response, config)
+
+	newCookie := assertReissuedCookie(t, response, config)
+	if newCookie == nil {
+		return
+	}
+
+	// Retire the old secret, the re-issued cookie should still be accepted
+	config.CookieSecrets = []string{testNewCookieSecret}
+
+	request, response = serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(newCookie)
+	})
+
+	assertProxiedDefaultAuth(t, request, response, config)
+
+	request, response = serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(oldCookie)
+	})
+
+	assertProxied(t, request, response, config, "")
+}
+
+func TestAuthHack_ServeHTTP_UsersFile_ValidQueryParam(t *testing.T) {
+	config := createTestConfig()
+	config.UsersFile = writeTestUsersFile(t, TestUsersFileContents)
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(DefaultUsernameQueryParam, TestUsername)
+		query.Add(DefaultPasswordQueryParam, TestPassword)
+		request.URL.RawQuery = query.Encode()
+	})
+
+	assertRedirectedDefaultAuth(t, request, response, config)
+}
+
+func TestAuthHack_ServeHTTP_UsersFile_InvalidQueryParam(t *testing.T) {
+	config := createTestConfig()
+	config.UsersFile = writeTestUsersFile(t, TestUsersFileContents)
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(DefaultUsernameQueryParam, TestUsername)
+		query.Add(DefaultPasswordQueryParam, TestPassword+"-wrong")
+		request.URL.RawQuery = query.Encode()
+	})
+
+	assertUnauthorized(t, request, response, config)
+}
+
+func TestAuthHack_ServeHTTP_UsersFile_HashTypes(t *testing.T) {
+	config := createTestConfig()
+	config.UsersFile = writeTestUsersFile(t, TestUsersFileContents)
+
+	for _, username := range []string{"sha1user", "md5user"} {
+		request, response := serveHTTP(t, config, func(request *http.Request) {
+			request.SetBasicAuth(username, TestPassword)
+		})
+
+		if request == nil {
+			t.Errorf("expected '%s' to be proxied but found status code '%v'", username, response.Code)
+		}
+	}
+}
+
+func TestAuthHack_ServeHTTP_UsersFile_NoAuth(t *testing.T) {
+	config := createTestConfig()
+	config.UsersFile = writeTestUsersFile(t, TestUsersFileContents)
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {})
+
+	assertUnauthorized(t, request, response, config)
+}
+
+func TestAuthHack_ServeHTTP_UsersFile_ValidCookie(t *testing.T) {
+	config := createTestConfig()
+	config.UsersFile = writeTestUsersFile(t, TestUsersFileContents)
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: TestUsernameAndPasswordEncodedWithoutPrefix})
+	})
+
+	assertProxiedDefaultAuth(t, request, response, config)
+}
+
+func TestAuthHack_ServeHTTP_UsersFile_InvalidCookie(t *testing.T) {
+	config := createTestConfig()
+	config.UsersFile = writeTestUsersFile(t, TestUsersFileContents)
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: TestUsernameEncodedWithoutPrefix})
+	})
+
+	assertUnauthorized(t, request, response, config)
+}
+
+func TestAuthHack_ServeHTTP_UsersFile_InvalidAuthHeader(t *testing.T) {
+	config := createTestConfig()
+	config.UsersFile = writeTestUsersFile(t, TestUsersFileContents)
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		request.SetBasicAuth(TestUsername, TestPassword+"-wrong")
+	})
+
+	assertUnauthorized(t, request, response, config)
+}
+
+func TestAuthHack_New_InvalidUsersFile(t *testing.T) {
+	config := createTestConfig()
+	config.UsersFile = writeTestUsersFile(t, "testusername:plaintext\n")
+
+	_, err := traefik_authhack.New(context.Background(), http.NotFoundHandler(), config, "test")
+	if err == nil {
+		t.Errorf("expected an error loading a users file with an unsupported hash")
+	}
+}
+
+func TestAuthHack_ServeHTTP_AuthQueryParam_Schemes(t *testing.T) {
+	for _, auth := range []string{TestBearerAuth, "bearer lowercase-scheme", "CustomScheme a=b, c=d"} {
+		config := createTestConfig()
+
+		request, response := serveHTTP(t, config, func(request *http.Request) {
+			query := request.URL.Query()
+			query.Add(DefaultAuthorizationQueryParam, auth)
+			request.URL.RawQuery = query.Encode()
+		})
+
+		assertRedirected(t, request, response, config, auth)
+	}
+}
+
+func TestAuthHack_ServeHTTP_AccessTokenQueryParam(t *testing.T) {
+	config := createTestConfig()
+	config.AccessTokenQueryParam = TestAccessTokenQueryParam
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(TestAccessTokenQueryParam, TestAccessToken)
+		request.URL.RawQuery = query.Encode()
+	})
+
+	assertRedirected(t, request, response, config, TestBearerAuth)
+}
+
+func TestAuthHack_ServeHTTP_AccessTokenQueryParam_DisabledByDefault(t *testing.T) {
+	config := createTestConfig()
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(TestAccessTokenQueryParam, TestAccessToken)
+		request.URL.RawQuery = query.Encode()
+	})
+
+	if request == nil {
+		t.Fatalf("expected request to be proxied - request should be set")
+	}
+
+	if response.Code != 0 {
+		t.Errorf("expected request to be proxied - response should not be sent (status code is '%v')", response.Code)
+	}
+
+	// The downstream service may read the param itself, so it's left untouched
+	if value := request.URL.Query().Get(TestAccessTokenQueryParam); value != TestAccessToken {
+		t.Errorf("expected query param '%s' to be kept but found '%s'", TestAccessTokenQueryParam, value)
+	}
+
+	assertRequestAuthorizationHeader(t, request, "")
+}
+
+func TestAuthHack_ServeHTTP_AccessTokenQueryParam_CustomConfig(t *testing.T) {
+	const testAccessTokenQueryParam = TestAccessTokenQueryParam + "-custom"
+
+	config := createTestConfig()
+	config.AccessTokenQueryParam = testAccessTokenQueryParam
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(testAccessTokenQueryParam, TestAccessToken)
+		request.URL.RawQuery = query.Encode()
+	})
+
+	assertRedirected(t, request, response, config, TestBearerAuth)
+}
+
+func TestAuthHack_ServeHTTP_AccessTokenQueryParam_MatchingCookie(t *testing.T) {
+	config := createTestConfig()
+	config.AccessTokenQueryParam = TestAccessTokenQueryParam
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(TestAccessTokenQueryParam, TestAccessToken)
+		request.URL.RawQuery = query.Encode()
+
+		request.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: TestBearerAuth})
+	})
+
+	assertProxied(t, request, response, config, TestBearerAuth)
+}
+
+func TestAuthHack_ServeHTTP_AccessTokenQueryParam_WithAuthQueryParam(t *testing.T) {
+	config := createTestConfig()
+	config.AccessTokenQueryParam = TestAccessTokenQueryParam
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(DefaultAuthorizationQueryParam, TestUsernameAndPasswordEncodedWithoutPrefix)
+		query.Add(TestAccessTokenQueryParam, TestAccessToken)
+		request.URL.RawQuery = query.Encode()
+	})
+
+	assertRedirectedDefaultAuth(t, request, response, config)
+}
+
+func TestAuthHack_ServeHTTP_AuthCookie_Schemes(t *testing.T) {
+	for _, auth := range []string{TestBearerAuth, "bearer lowercase-scheme", "CustomScheme a=b"} {
+		config := createTestConfig()
+
+		request, response := serveHTTP(t, config, func(request *http.Request) {
+			request.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: auth})
+		})
+
+		assertProxied(t, request, response, config, auth)
+	}
+}
+
+func TestAuthHack_ServeHTTP_AuthHeader_Bearer(t *testing.T) {
+	config := createTestConfig()
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		request.Header.Add(traefik_authhack.AuthorizationHeader, TestBearerAuth)
+	})
+
+	assertProxied(t, request, response, config, TestBearerAuth)
+}
+
+func TestAuthHack_ServeHTTP_EncryptedCookie_Bearer(t *testing.T) {
+	config := createTestConfig()
+	config.CookieSecret = TestCookieSecret
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(DefaultAuthorizationQueryParam, TestBearerAuth)
+		request.URL.RawQuery = query.Encode()
+	})
+
+	cookie := assertRedirectedWithCookie(t, request, response, config)
+	if cookie == nil {
+		return
+	}
+
+	request, response = serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(cookie)
+	})
+
+	assertProxied(t, request, response, config, TestBearerAuth)
+}
+
+func TestAuthHack_ServeHTTP_UsersFile_Bearer(t *testing.T) {
+	config := createTestConfig()
+	config.UsersFile = writeTestUsersFile(t, TestUsersFileContents)
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(DefaultAuthorizationQueryParam, TestBearerAuth)
+		request.URL.RawQuery = query.Encode()
+	})
+
+	assertUnauthorized(t, request, response, config)
+}
+
+func TestAuthHack_ServeHTTP_JWT_ValidAccessToken(t *testing.T) {
+	config := createTestConfig()
+	config.AccessTokenQueryParam = TestAccessTokenQueryParam
+	config.JWTSecret = TestJWTSecret
+
+	token := signTestJWT(t, TestJWTSecret, map[string]any{"sub": TestUsername, "exp": time.Now().Add(time.Hour).Unix()})
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		query := request.URL.Query()
+		query.Add(TestAccessTokenQueryParam, token)
+		request.URL.RawQuery = query.Encode()
+	})
+
+	assertRedirected(t, request, response, config, "Bearer "+token)
+}
+
+func TestAuthHack_ServeHTTP_JWT_InvalidAccessToken(t *testing.T) {
+	tokens := map[string]string{
+		"NotJWT":      TestAccessToken,
+		"WrongSecret": signTestJWT(t, TestJWTSecret+"-other", map[string]any{"sub": TestUsername}),
+		"Expired":     signTestJWT(t, TestJWTSecret, map[string]any{"sub": TestUsername, "exp": time.Now().Add(-time.Hour).Unix()}),
+	}
+
+	for name, token := range tokens {
+		t.Run(name, func(t *testing.T) {
+			config := createTestConfig()
+			config.AccessTokenQueryParam = TestAccessTokenQueryParam
+			config.JWTSecret = TestJWTSecret
+
+			request, response := serveHTTP(t, config, func(request *http.Request) {
+				query := request.URL.Query()
+				query.Add(TestAccessTokenQueryParam, token)
+				request.URL.RawQuery = query.Encode()
+			})
+
+			assertInvalidToken(t, request, response, config)
+		})
+	}
+}
+
+func TestAuthHack_ServeHTTP_JWT_InvalidCookie(t *testing.T) {
+	config := createTestConfig()
+	config.JWTSecret = TestJWTSecret
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: TestBearerAuth})
+	})
+
+	assertInvalidToken(t, request, response, config)
+}
+
+func TestAuthHack_ServeHTTP_JWT_UsersFile(t *testing.T) {
+	config := createTestConfig()
+	config.UsersFile = writeTestUsersFile(t, TestUsersFileContents)
+	config.JWTSecret = TestJWTSecret
+
+	token := signTestJWT(t, TestJWTSecret, map[string]any{"sub": TestUsername})
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: "Bearer " + token})
+	})
+
+	assertProxied(t, request, response, config, "Bearer "+token)
+
+	// Basic credentials are still verified against the users file
+	request, response = serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: TestUsernameAndPasswordEncodedWithoutPrefix})
+	})
+
+	assertProxiedDefaultAuth(t, request, response, config)
+}
+
+func TestAuthHack_ServeHTTP_JWT_ClaimHeaders(t *testing.T) {
+	config := createTestConfig()
+	config.JWTSecret = TestJWTSecret
+	config.JWTClaimHeaders = map[string]string{"sub": "X-Auth-Request-User", "groups": "X-Auth-Request-Groups", "email": "X-Auth-Request-Email"}
+
+	token := signTestJWT(t, TestJWTSecret, map[string]any{"sub": TestUsername, "groups": []string{"admin", "users"}})
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: "Bearer " + token})
+		request.Header.Add("X-Auth-Request-User", "spoofed")
+		request.Header.Add("X-Auth-Request-Email", "spoofed@example.com")
+	})
+
+	assertProxied(t, request, response, config, "Bearer "+token)
+	assertRequestHeader(t, request, "X-Auth-Request-User", TestUsername)
+	assertRequestHeader(t, request, "X-Auth-Request-Groups", "admin,users")
+	assertRequestHeader(t, request, "X-Auth-Request-Email", "")
+}
+
+func TestAuthHack_ServeHTTP_JWT_ClaimHeaders_AuthHeader(t *testing.T) {
+	config := createTestConfig()
+	config.JWTSecret = TestJWTSecret
+	config.JWTClaimHeaders = map[string]string{"sub": "X-Auth-Request-User"}
+
+	token := signTestJWT(t, TestJWTSecret, map[string]any{"sub": TestUsername})
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		request.Header.Add(traefik_authhack.AuthorizationHeader, "Bearer "+token)
+		request.Header.Add("X-Auth-Request-User", "spoofed")
+	})
+
+	assertProxied(t, request, response, config, "Bearer "+token)
+	assertRequestHeader(t, request, "X-Auth-Request-User", TestUsername)
+}
+
+func TestAuthHack_ServeHTTP_JWT_ClaimHeaders_ScrubbedWithoutToken(t *testing.T) {
+	config := createTestConfig()
+	config.JWTSecret = TestJWTSecret
+	config.JWTClaimHeaders = map[string]string{"sub": "X-Auth-Request-User"}
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: TestUsernameAndPasswordEncodedWithoutPrefix})
+		request.Header.Add("X-Auth-Request-User", "spoofed")
+	})
+
+	assertProxiedDefaultAuth(t, request, response, config)
+	assertRequestHeader(t, request, "X-Auth-Request-User", "")
+}
+
+func TestAuthHack_New_InvalidClaimHeaders(t *testing.T) {
+	for _, claimHeaders := range []map[string]string{
+		{"sub": ""},
+		{"sub": "authorization"},
+		{"sub": "cookie"},
+		{"sub": "Host"},
+		{"sub": "Forwarded"},
+		{"sub": "x-forwarded-for"},
+		{"sub": "X-Forwarded-User"},
+		{"sub": "Connection"},
+		{"sub": "Transfer-Encoding"},
+	} {
+		config := createTestConfig()
+		config.JWTSecret = TestJWTSecret
+		config.JWTClaimHeaders = claimHeaders
+
+		if _, err := traefik_authhack.New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+			t.Errorf("expected JWTClaimHeaders '%v' to be rejected", claimHeaders)
+		}
+	}
+}
+
+func TestAuthHack_ServeHTTP_Login_RedirectsWithoutCredentials(t *testing.T) {
+	config := createTestConfig()
+	config.LoginPath = TestLoginPath
+
+	request, response := serveHTTP(t, config, func(request *http.Request) {
+		request.URL.Path = "/page"
+		request.URL.RawQuery = "a=b"
+		request.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	})
+
+	if request != nil {
+		t.Errorf("expected request to be redirected - request should not be set")
+	}
+
+	if response.Code != http.StatusFound {
+		t.Errorf("expected found status code ('%v') but found '%v'", http.StatusFound, response.Code)
+	}
+
+	expectedLocation := TestLoginPath + "?return_to=%2Fpage%3Fa%3Db"
+	if location := response.Header().Get("Location"); location != expectedLocation {
+		t.Errorf("expected location to be '%s' but found '%s'", expectedLocation, location)
+	}
+
+	// Only page loads are redirected, other requests can't use the form
+	tests := []struct {
+		name             string
+		method           string
+		headers          map[string]string
+		expectRedirected bool
+	}{
+		{"Navigate", http.MethodGet, map[string]string{"Sec-Fetch-Mode": "navigate"}, true},
+		{"Post", http.MethodPost, map[string]string{"Accept": "text/html"}, false},
+		{"Fetch", http.MethodGet, map[string]string{"Accept": "text/html", "Sec-Fetch-Mode": "cors"}, false},
+		{"Asset", http.MethodGet, map[string]string{"Accept": "image/avif,image/webp,*/*"}, false},
+		{"NoAccept", http.MethodGet, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := serveHTTP(t, config, func(request *http.Request) {
+				request.Method = test.method
+				for key, value := range test.headers {
+					request.Header.Set(key, value)
+				}
+			})
+
+			if redirected := request == nil; redirected != test.expectRedirected {
+				t.Errorf("expected request to be redirected to be '%v' but found '%v'", test.expectRedirected, redirected)
+			}
+		})
+	}
+}
+
+func TestAuthHack_ServeHTTP_Login(t *testing.T) {
+	config := createTestConfig()
+	config.UsersFile = writeTestUsersFile(t, TestUsersFileContents)
+	config.LoginPath = TestLoginPath
+
+	csrfCookie := getTestLoginPage(t, config, "/page?a=b")
+
+	request, response := postTestLogin(t, config, csrfCookie, csrfCookie.Value, TestUsername, TestPassword, "/page?a=b")
+	if request != nil {
+		t.Errorf("expected login not to be proxied - request should not be set")
+	}
+
+	if response.Code != http.StatusSeeOther {
+		t.Fatalf("expected see other status code ('%v') but found '%v'", http.StatusSeeOther, response.Code)
+	}
+
+	if location := response.Header().Get("Location"); location != "/page?a=b" {
+		t.Errorf("expected location to be '/page?a=b' but found '%s'", location)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range response.Result().Cookies() {
+		if c.Name == config.CookieName {
+			cookie = c
+		}
+	}
+
+	if cookie == nil {
+		t.Fatalf("expected auth cookie to be set")
+	}
+
+	request, response = serveHTTP(t, config, func(request *http.Request) {
+		request.AddCookie(cookie)
+	})
+
+	assertProxiedDefaultAuth(t, request, response, config)
+}
+
+func TestAuthHack_ServeHTTP_Login_Rejected(t *testing.T) {
+	config := createTestConfig()
+	config.UsersFile = writeTestUsersFile(t, TestUsersFileContents)
+	config.LoginPath = TestLoginPath
+
+	csrfCookie := getTestLoginPage(t, config, "/")
+
+	tests := []struct {
+		name               string
+		csrfCookie         *http.Cookie
+		csrfToken          string
+		password           string
+		expectedStatusCode int
+	}{
+		{"InvalidPassword", csrfCookie, csrfCookie.Value, "wrongpassword", http.StatusUnauthorized},
+		{"MissingCSRFCookie", nil, csrfCookie.Value, TestPassword, http.StatusForbidden},
+		{"MismatchedCSRFToken", csrfCookie, "mismatched", TestPassword, http.StatusForbidden},
+		{"MissingCSRFToken", csrfCookie, "", TestPassword, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, response := postTestLogin(t, config, test.csrfCookie, test.csrfToken, TestUsername, test.password, "/")
+			if response.Code != test.expectedStatusCode {
+				t.Errorf("expected status code '%v' but found '%v'", test.expectedStatusCode, response.Code)
+			}
+
+			for _, cookie := range response.Result().Cookies() {
+				if cookie.Name == config.CookieName {
+					t.Errorf("expected no auth cookie to be set but found '%s'", cookie)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthHack_ServeHTTP_Login_UnsafeReturnTo(t *testing.T) {
+	config := createTestConfig()
+	config.LoginPath = TestLoginPath
+
+	for _, returnTo := range []string{"https://example.com/", "//example.com/", "/\\example.com/", "javascript:alert(1)", "page", TestLoginPath} {
+		csrfCookie := getTestLoginPage(t, config, returnTo)
+
+		_, response := postTestLogin(t, config, csrfCookie, csrfCookie.Value, TestUsername, TestPassword, returnTo)
+
+		if location := response.Header().Get("Location"); location != "/" {
+			t.Errorf("expected return to '%s' to redirect to '/' but found '%s'", returnTo, location)
+		}
+	}
+}
+
+func TestAuthHack_ServeHTTP_Login_Template(t *testing.T) {
+	templateFile := filepath.Join(t.TempDir(), "login.html")
+	if err := os.WriteFile(templateFile, []byte(`<p>{{.Realm}}</p><input name="{{.CSRFField}}" value="{{.CSRFToken}}">`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := createTestConfig()
+	config.LoginPath = TestLoginPath
+	config.LoginTemplateFile = templateFile
+	config.Realm = "<realm>"
+
+	_, response := serveHTTP(t, config, func(request *http.Request) {
+		request.URL.Path = TestLoginPath
+	})
+
+	if body := response.Body.String(); !strings.HasPrefix(body, "<p>&lt;realm&gt;</p>") {
+		t.Errorf("expected login page to be rendered from the template but found '%s'", body)
+	}
+}
+
+func BenchmarkAuthHack_ServeHTTP_UsersFile_Cached(b *testing.B) {
+	benchmarkServeHTTPUsersFile(b, "5m")
+}
+
+func BenchmarkAuthHack_ServeHTTP_UsersFile_Uncached(b *testing.B) {
+	benchmarkServeHTTPUsersFile(b, "")
+}
+
+func benchmarkServeHTTPUsersFile(b *testing.B, verificationCacheTTL string) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(TestPassword), bcrypt.DefaultCost)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	usersFile := filepath.Join(b.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte(TestUsername+":"+string(hash)), 0600); err != nil {
+		b.Fatal(err)
+	}
+
+	config := traefik_authhack.CreateConfig()
+	config.LogLevel = traefik_authhack.None
+	config.UsersFile = usersFile
+	config.VerificationCacheTTL = verificationCacheTTL
+
+	handler, err := traefik_authhack.New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), config, "test")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cookie := &http.Cookie{Name: DefaultCookieName, Value: TestUsernameAndPasswordEncodedWithoutPrefix}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		request := httptest.NewRequest(http.MethodGet, TestURL, nil)
+		request.AddCookie(cookie)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusOK {
+			b.Fatalf("expected request to be proxied but found status code '%v'", recorder.Code)
+		}
+	}
+}
+
 func createTestConfig() *traefik_authhack.Config {
 	config := traefik_authhack.CreateConfig()
 	config.LogLevel = traefik_authhack.All
@@ -234,6 +1001,7 @@ func assertProxiedDefaultAuth(t *testing.T, request *http.Request, response *htt
 
 func assertRequestScrubbed(t *testing.T, request *http.Request, config *traefik_authhack.Config) {
 	assertRequestQueryParamScrubbed(t, request, config.AuthorizationQueryParam)
+	assertRequestQueryParamScrubbed(t, request, config.AccessTokenQueryParam)
 	assertRequestQueryParamScrubbed(t, request, config.UsernameQueryParam)
 	assertRequestQueryParamScrubbed(t, request, config.PasswordQueryParam)
 
@@ -265,6 +1033,13 @@ func assertRequestAuthorizationHeader(t *testing.T, request *http.Request, expec
 }
 
 func assertRedirected(t *testing.T, request *http.Request, response *httptest.ResponseRecorder, config *traefik_authhack.Config, expectedAuth string) {
+	cookie := assertRedirectedWithCookie(t, request, response, config)
+	if cookie != nil && cookie.Value != expectedAuth {
+		t.Errorf("expected cookie value to be auth '%s' but found '%s'", expectedAuth, cookie.Value)
+	}
+}
+
+func assertRedirectedWithCookie(t *testing.T, request *http.Request, response *httptest.ResponseRecorder, config *traefik_authhack.Config) *http.Cookie {
 	if request != nil {
 		t.Errorf("expected redirect - request should not be set")
 	}
@@ -282,42 +1057,173 @@ func assertRedirected(t *testing.T, request *http.Request, response *httptest.Re
 	setCookieHeaderValue := response.Header().Get("Set-Cookie")
 	if setCookieHeaderValue == "" {
 		t.Errorf("expected Set-Cookie header but didn't find any")
-	} else {
-		cookie, err := parseCookie(setCookieHeaderValue)
-		if err != nil {
-			t.Errorf("expected cookie but couldn't parse '%s': '%v'", setCookieHeaderValue, err)
-		} else if cookie == nil {
-			t.Errorf("expected Set-Cookie header to be valid but failed to parse '%s'", setCookieHeaderValue)
-		} else {
-			if cookie.Name != config.CookieName {
-				t.Errorf("expected cookie name to be '%s' but found '%s'", config.CookieName, cookie.Name)
-			}
-			if cookie.Value != expectedAuth {
-				t.Errorf("expected cookie value to be auth '%s' but found '%s'", expectedAuth, cookie.Value)
-			}
-			if cookie.Domain != config.CookieDomain {
-				t.Errorf("expected cookie domain to be '%s' but found '%s'", config.CookieDomain, cookie.Domain)
-			}
-			if cookie.Path != config.CookiePath {
-				t.Errorf("expected cookie path to be '%s' but found '%s'", config.CookiePath, cookie.Path)
-			}
-			if !cookie.Secure {
-				t.Errorf("expected cookie to be secure but found '%v'", cookie.Secure)
-			}
-			if !cookie.HttpOnly {
-				t.Errorf("expected cookie to be HTTP only found '%v'", cookie.HttpOnly)
-			}
-			if cookie.SameSite != http.SameSiteStrictMode {
-				t.Errorf("expected cookie same site to be strict but found '%v'", cookie.SameSite)
-			}
-		}
+
+		return nil
+	}
+
+	cookie, err := parseCookie(setCookieHeaderValue)
+	if err != nil {
+		t.Errorf("expected cookie but couldn't parse '%s': '%v'", setCookieHeaderValue, err)
+
+		return nil
+	} else if cookie == nil {
+		t.Errorf("expected Set-Cookie header to be valid but failed to parse '%s'", setCookieHeaderValue)
+
+		return nil
+	}
+
+	if cookie.Name != config.CookieName {
+		t.Errorf("expected cookie name to be '%s' but found '%s'", config.CookieName, cookie.Name)
+	}
+	if cookie.Domain != config.CookieDomain {
+		t.Errorf("expected cookie domain to be '%s' but found '%s'", config.CookieDomain, cookie.Domain)
+	}
+	if cookie.Path != config.CookiePath {
+		t.Errorf("expected cookie path to be '%s' but found '%s'", config.CookiePath, cookie.Path)
+	}
+	if !cookie.Secure {
+		t.Errorf("expected cookie to be secure but found '%v'", cookie.Secure)
+	}
+	if !cookie.HttpOnly {
+		t.Errorf("expected cookie to be HTTP only found '%v'", cookie.HttpOnly)
+	}
+	if cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("expected cookie same site to be strict but found '%v'", cookie.SameSite)
+	}
+
+	return cookie
+}
+
+func assertReissuedCookie(t *testing.T, response *httptest.ResponseRecorder, config *traefik_authhack.Config) *http.Cookie {
+	setCookieHeaderValue := response.Header().Get("Set-Cookie")
+	if setCookieHeaderValue == "" {
+		t.Errorf("expected cookie to be re-issued but didn't find a Set-Cookie header")
+
+		return nil
+	}
+
+	cookie, err := parseCookie(setCookieHeaderValue)
+	if err != nil {
+		t.Errorf("expected cookie but couldn't parse '%s': '%v'", setCookieHeaderValue, err)
+
+		return nil
+	}
+
+	if cookie.Name != config.CookieName {
+		t.Errorf("expected cookie name to be '%s' but found '%s'", config.CookieName, cookie.Name)
+	}
+	if !strings.HasPrefix(cookie.Value, "v3.") {
+		t.Errorf("expected re-issued cookie value to be versioned but found '%s'", cookie.Value)
 	}
+
+	return cookie
 }
 
 func assertRedirectedDefaultAuth(t *testing.T, request *http.Request, response *httptest.ResponseRecorder, config *traefik_authhack.Config) {
 	assertRedirected(t, request, response, config, TestUsernameAndPasswordEncodedWithoutPrefix)
 }
 
+func writeTestUsersFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func assertUnauthorized(t *testing.T, request *http.Request, response *httptest.ResponseRecorder, config *traefik_authhack.Config) {
+	if request != nil {
+		t.Errorf("expected request to be rejected - request should not be set")
+	}
+
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized status code ('%v') but found '%v'", http.StatusUnauthorized, response.Code)
+	}
+
+	expectedAuthenticate := fmt.Sprintf("Basic realm=%q", config.Realm)
+	if actual := response.Header().Get("WWW-Authenticate"); actual != expectedAuthenticate {
+		t.Errorf("expected WWW-Authenticate header to be '%s' but found '%s'", expectedAuthenticate, actual)
+	}
+
+	if setCookie := response.Header().Get("Set-Cookie"); setCookie != "" {
+		t.Errorf("expected no cookie to be set but found '%s'", setCookie)
+	}
+}
+
+// getTestLoginPage loads the login page, returning the CSRF cookie.
+func getTestLoginPage(t *testing.T, config *traefik_authhack.Config, returnTo string) *http.Cookie {
+	_, response := serveHTTP(t, config, func(request *http.Request) {
+		request.URL.Path = TestLoginPath
+		request.URL.RawQuery = url.Values{"return_to": {returnTo}}.Encode()
+	})
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected login page to be served but found status code '%v'", response.Code)
+	}
+
+	cookies := response.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value == "" || !strings.Contains(response.Body.String(), cookies[0].Value) {
+		t.Fatalf("expected CSRF cookie to be set and match the form")
+	}
+
+	return cookies[0]
+}
+
+func postTestLogin(t *testing.T, config *traefik_authhack.Config, csrfCookie *http.Cookie, csrfToken, username, password, returnTo string) (*http.Request, *httptest.ResponseRecorder) {
+	return serveHTTP(t, config, func(request *http.Request) {
+		form := url.Values{"csrf_token": {csrfToken}, "username": {username}, "password": {password}, "return_to": {returnTo}}
+
+		request.Method = http.MethodPost
+		request.URL.Path = TestLoginPath
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.Body = io.NopCloser(strings.NewReader(form.Encode()))
+
+		if csrfCookie != nil {
+			request.AddCookie(&http.Cookie{Name: csrfCookie.Name, Value: csrfCookie.Value})
+		}
+	})
+}
+
+func assertInvalidToken(t *testing.T, request *http.Request, response *httptest.ResponseRecorder, config *traefik_authhack.Config) {
+	if request != nil {
+		t.Errorf("expected request to be rejected - request should not be set")
+	}
+
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized status code ('%v') but found '%v'", http.StatusUnauthorized, response.Code)
+	}
+
+	expectedAuthenticate := fmt.Sprintf("Bearer realm=%q, error=\"invalid_token\"", config.Realm)
+	if actual := response.Header().Get("WWW-Authenticate"); actual != expectedAuthenticate {
+		t.Errorf("expected WWW-Authenticate header to be '%s' but found '%s'", expectedAuthenticate, actual)
+	}
+
+	cookie, err := parseCookie(response.Header().Get("Set-Cookie"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cookie.Name != config.CookieName || cookie.MaxAge >= 0 {
+		t.Errorf("expected cookie to be cleared but found '%s'", cookie)
+	}
+}
+
+// signTestJWT returns an HS256 JWT with the claims.
+func signTestJWT(t *testing.T, secret string, claims map[string]any) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
 func parseCookie(s string) (*http.Cookie, error) {
 	header := http.Header{}
 	header.Add("Set-Cookie", s)
@@ -0,0 +1,321 @@
+package traefik_authhack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// bundleParam is the query param of BundlePath that holds the sealed bundle
+const bundleParam = "bundle"
+
+// bundleAdditionalData is bound to sealed bundles so that they can't be used as cookies, or cookies as bundles, even
+// if the same secret is configured for both
+const bundleAdditionalData = "traefik-authhack bundle"
+
+// loginBundle holds credentials for several services, so that one link can log the client into all of them. It's
+// sealed with BundleSecret, so it can neither be read nor forged by the client.
+type loginBundle struct {
+	Entries   []loginBundleEntry `json:"entries"`
+	ExpiresAt int64              `json:"exp"`
+}
+
+// loginBundleEntry is a credential for the services at a scope, a host optionally followed by one of
+// CredentialPathPrefixes (see cookieScope).
+type loginBundleEntry struct {
+	Scope string                   `json:"scope"`
+	Auth  encodedAuthWithoutPrefix `json:"auth"`
+}
+
+// Hosts returns the hosts the bundle has credentials for, in the order they're visited.
+func (b loginBundle) Hosts() []string {
+	var hosts []string
+	seen := make(map[string]bool)
+
+	for _, entry := range b.Entries {
+		host := entry.Host()
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts
+}
+
+func (e loginBundleEntry) Host() string {
+	host, _, _ := strings.Cut(e.Scope, "/")
+
+	return host
+}
+
+func (p *AuthHackPlugin) sealBundle(bundle loginBundle) (string, error) {
+	encoded, err := json.Marshal(bundle)
+	if err != nil {
+		return "", err
+	}
+
+	return p.bundleCipher.Seal(newCookiePayload(string(encoded), p.now()))
+}
+
+func (p *AuthHackPlugin) openBundle(sealed string) (loginBundle, error) {
+	payload, _, err := p.bundleCipher.Open(sealed)
+	if err != nil {
+		return loginBundle{}, err
+	}
+
+	var bundle loginBundle
+	if err := json.Unmarshal([]byte(payload.Value), &bundle); err != nil {
+		return loginBundle{}, errCookieMalformed
+	}
+
+	if !p.now().Before(time.Unix(bundle.ExpiresAt, 0)) {
+		return loginBundle{}, errors.New("bundle has expired")
+	}
+
+	return bundle, nil
+}
+
+// serveBundle stores the credentials a bundle has for the current host in the cookie, then redirects to the next host
+// in the bundle or, once every host has been visited, to BundleRedirectURL. If the cookie holds an entry per host and
+// is shared by every host (see CookieDomain), every credential is stored at once.
+func (p *AuthHackPlugin) serveBundle(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		responseWriter.Header().Set("Allow", "GET, HEAD")
+
+		http.Error(responseWriter, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	// Bundles are credentials in the query params, so they're only used from the same clients
+	if !p.isQueryAuthAllowed(request) {
+		if p.config.QueryAuthDeniedAction == QueryAuthDeniedReject {
+			p.log(Info, "rejecting bundle from '%s': not an allowed IP", p.clientIP(request))
+
+			http.Error(responseWriter, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+			return
+		}
+
+		// Carry on without the bundle, using the cookie if it's already set
+		p.log(Info, "ignoring bundle from '%s': not an allowed IP", p.clientIP(request))
+
+		responseWriter.Header().Set("Cache-Control", "no-store")
+		responseWriter.Header().Set("Referrer-Policy", "no-referrer")
+
+		http.Redirect(responseWriter, request, p.config.BundleRedirectURL, http.StatusFound)
+
+		return
+	}
+
+	sealed := request.URL.Query().Get(bundleParam)
+
+	bundle, err := p.openBundle(sealed)
+	if err != nil {
+		p.log(Info, "rejecting bundle: %v", err)
+
+		http.Error(responseWriter, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+		return
+	}
+
+	host := requestHost(request.Host)
+	sharedCookie := p.config.MultiCredentialCookie && p.config.CookieDomain != ""
+
+	var entries []loginBundleEntry
+	for _, entry := range bundle.Entries {
+		if sharedCookie || entry.Host() == host {
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(entries) == 0 {
+		p.log(Info, "rejecting bundle: no credentials for host '%s'", host)
+
+		http.Error(responseWriter, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+		return
+	}
+
+	// Don't store any of the credentials unless all of them are valid, the bundle has to be replaced
+	for _, entry := range entries {
+		if _, err := p.validateToken(entry.Auth); err != nil || !p.verifyAuth(entry.Auth) {
+			p.log(Info, "rejecting bundle: invalid credentials for '%s'", entry.Scope)
+
+			http.Error(responseWriter, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+			return
+		}
+	}
+
+	var payload cookiePayload
+	if cookie, err := request.Cookie(p.config.CookieName); err == nil {
+		payload, _ = p.decodeCookieValue(cookie.Value)
+	}
+
+	for _, entry := range entries {
+		var scope string
+		if p.config.MultiCredentialCookie {
+			scope = entry.Scope
+		}
+
+		previous, cookieEntries := p.selectCookieEntry(payload, scope)
+
+		cookieValue, err := p.newCookieValue(entry.Auth, p.sessionClient(request))
+		if err != nil {
+			p.log(Error, "encountered error encoding cookie: %v", err)
+
+			http.Error(responseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+			return
+		}
+
+		payload = p.withCookieEntry(newCookiePayload(cookieValue, p.now()), cookieEntries, scope)
+
+		// The previous session, if any, is replaced by the new one
+		p.deleteCookieSession(previous)
+	}
+
+	if err := p.setAuthCookie(responseWriter, payload); err != nil {
+		p.log(Error, "encountered error encoding cookie: %v", err)
+
+		http.Error(responseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+		return
+	}
+
+	location := p.config.BundleRedirectURL
+	if !sharedCookie {
+		hosts := bundle.Hosts()
+		for i, h := range hosts {
+			if h == host && i+1 < len(hosts) {
+				location = p.bundleURL(hosts[i+1], sealed)
+			}
+		}
+	}
+
+	p.log(Debug, "stored bundle credentials for '%s', redirecting to '%s'", host, location)
+
+	responseWriter.Header().Set("Cache-Control", "no-store")
+	// The bundle is in the URL, don't leak it to the next page
+	responseWriter.Header().Set("Referrer-Policy", "no-referrer")
+
+	http.Redirect(responseWriter, request, location, http.StatusFound)
+}
+
+// bundleURL returns the URL of BundlePath on the host for the sealed bundle.
+func (p *AuthHackPlugin) bundleURL(host, sealed string) string {
+	return (&url.URL{Scheme: "https", Host: host, Path: p.config.BundlePath, RawQuery: url.Values{bundleParam: {sealed}}.Encode()}).String()
+}
+
+// adminBundleRequest is the body of a request to create a bundle through the admin API.
+type adminBundleRequest struct {
+	Credentials []struct {
+		// Host is the host the credentials are for, optionally followed by one of CredentialPathPrefixes
+		Host string `json:"host"`
+
+		// Either Authorization, a complete Authorization header value, or Username and Password
+		Authorization string `json:"authorization"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+	} `json:"credentials"`
+}
+
+// createAdminBundle seals a bundle with the credentials from the request, responding with the link that redeems it.
+func (p *AuthHackPlugin) createAdminBundle(responseWriter http.ResponseWriter, request *http.Request) {
+	var body adminBundleRequest
+
+	request.Body = http.MaxBytesReader(responseWriter, request.Body, adminMaxBodySize)
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil || len(body.Credentials) == 0 {
+		p.log(Info, "rejecting admin bundle: body is malformed or has no credentials")
+
+		p.writeAdminError(responseWriter, http.StatusBadRequest)
+
+		return
+	}
+
+	bundle := loginBundle{ExpiresAt: p.now().Add(p.bundleLifetime).Unix()}
+
+	for _, credentials := range body.Credentials {
+		scope, err := p.parseBundleScope(credentials.Host)
+		if err != nil {
+			p.log(Info, "rejecting admin bundle: %v", err)
+
+			p.writeAdminError(responseWriter, http.StatusBadRequest)
+
+			return
+		}
+
+		var auth encodedAuthWithoutPrefix
+		if credentials.Authorization != "" {
+			auth = newEncodedAuthWithoutPrefix(credentials.Authorization)
+		} else if credentials.Username != "" {
+			auth = encodeAuthWithoutPrefix(credentials.Username, credentials.Password)
+		}
+
+		if auth.IsEmpty() {
+			p.log(Info, "rejecting admin bundle: no credentials for '%s'", scope)
+
+			p.writeAdminError(responseWriter, http.StatusBadRequest)
+
+			return
+		}
+
+		if _, err := p.validateToken(auth); err != nil || !p.verifyAuth(auth) {
+			p.log(Info, "rejecting admin bundle: invalid credentials for '%s'", scope)
+
+			p.writeAdminError(responseWriter, http.StatusBadRequest)
+
+			return
+		}
+
+		bundle.Entries = append(bundle.Entries, loginBundleEntry{Scope: scope, Auth: auth})
+	}
+
+	sealed, err := p.sealBundle(bundle)
+	if err != nil {
+		p.log(Error, "encountered error sealing bundle: %v", err)
+
+		p.writeAdminError(responseWriter, http.StatusInternalServerError)
+
+		return
+	}
+
+	p.log(Info, "created bundle for %d hosts through the admin API", len(bundle.Hosts()))
+
+	p.writeAdminJSON(responseWriter, http.StatusOK, map[string]any{
+		"url":       p.bundleURL(bundle.Hosts()[0], sealed),
+		"expiresAt": time.Unix(bundle.ExpiresAt, 0).UTC(),
+	})
+}
+
+// parseBundleScope normalizes the scope of bundle credentials, which is a host optionally followed by one of
+// CredentialPathPrefixes.
+func (p *AuthHackPlugin) parseBundleScope(scope string) (string, error) {
+	host, prefix, hasPrefix := strings.Cut(scope, "/")
+	host = strings.ToLower(host)
+
+	parsed, err := url.Parse("https://" + host)
+	if err != nil || host == "" || parsed.Host != host || parsed.Port() != "" {
+		return "", fmt.Errorf("invalid host '%s'", scope)
+	}
+
+	if !hasPrefix {
+		return host, nil
+	}
+
+	if p.config.MultiCredentialCookie {
+		for _, configured := range p.config.CredentialPathPrefixes {
+			if strings.TrimSuffix(configured, "/") == "/"+strings.TrimSuffix(prefix, "/") {
+				return host + "/" + strings.TrimSuffix(prefix, "/"), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("invalid host '%s': path must be one of CredentialPathPrefixes", scope)
+}
@@ -0,0 +1,130 @@
+package traefik_authhack
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedHeader is the standard header (RFC 7239) proxies can report the client's address in
+const ForwardedHeader = "Forwarded"
+
+// XForwardedForHeader is the de facto header proxies report the client's address in
+const XForwardedForHeader = "X-Forwarded-For"
+
+// clientIPResolver resolves the IP address of the client making a request, which may have passed through trusted
+// proxies that each append the address they received it from to a header.
+type clientIPResolver struct {
+	trustedProxies ipList
+	// header is XForwardedForHeader or ForwardedHeader. Only one is used, since a proxy only appends to one and the
+	// client could forge the other.
+	header string
+}
+
+// Resolve returns the address that the request was received from, unless that is a trusted proxy. In that case, the
+// header is walked from the right (the address the proxy received the request from) to the first address that isn't a
+// trusted proxy. Anything to its left was reported by the client, so it can't be trusted. If an address in the header
+// can't be parsed, the proxy that added it is returned.
+func (r clientIPResolver) Resolve(request *http.Request) string {
+	ip := parseHopIP(request.RemoteAddr)
+	if ip == "" {
+		return request.RemoteAddr
+	}
+
+	if len(r.trustedProxies) == 0 {
+		return ip
+	}
+
+	var hops []string
+	if r.header == ForwardedHeader {
+		hops = parseForwardedHops(request.Header.Values(ForwardedHeader))
+	} else {
+		for _, value := range request.Header.Values(XForwardedForHeader) {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0 && r.trustedProxies.Contains(ip); i-- {
+		hop := parseHopIP(hops[i])
+		if hop == "" {
+			break
+		}
+
+		ip = hop
+	}
+
+	return ip
+}
+
+// parseHopIP returns the normalized IP address of a hop, which may have a port and IPv6 addresses may be in brackets,
+// or "" if it isn't an IP address (e.g. "unknown" or an obfuscated identifier).
+func parseHopIP(hop string) string {
+	hop = strings.TrimSpace(hop)
+
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip.String()
+	}
+
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	} else {
+		hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	}
+
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip.String()
+	}
+
+	return ""
+}
+
+// parseForwardedHops returns the 'for' parameter of each element of Forwarded headers (RFC 7239), in order. Elements
+// without one are returned as "", so they can't be skipped over.
+func parseForwardedHops(values []string) []string {
+	var hops []string
+
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			var hop string
+
+			for _, pair := range splitQuoted(element, ';') {
+				name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(name, "for") {
+					hop = strings.Trim(value, "\"")
+				}
+			}
+
+			hops = append(hops, hop)
+		}
+	}
+
+	return hops
+}
+
+// splitQuoted splits the value on the separator, except inside quoted strings.
+func splitQuoted(value string, separator byte) []string {
+	var parts []string
+	var quoted, escaped bool
+	start := 0
+
+	for i := 0; i < len(value); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && value[i] == '\\':
+			escaped = true
+		case value[i] == '"':
+			quoted = !quoted
+		case !quoted && value[i] == separator:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, value[start:])
+}
+
+// clientIP returns the IP address of the client making the request, see clientIPResolver.
+func (p *AuthHackPlugin) clientIP(request *http.Request) string {
+	return p.clientIPResolver.Resolve(request)
+}
@@ -0,0 +1,177 @@
+package traefik_authhack
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// cookieValueV3Prefix marks cookie values sealed with the current format: a signed cookiePayload.
+const cookieValueV3Prefix = "v3."
+
+// cookieValueV2Prefix marks cookie values sealed with the previous format, which holds only the encoded auth. They
+// carry no timestamps, so they're only accepted when no cookie lifetime is enforced, see decodeCookieValue.
+const cookieValueV2Prefix = "v2."
+
+// cookieSigningLabel is mixed into each secret to derive a signing key distinct from the encryption key
+const cookieSigningLabel = "traefik-authhack cookie signing"
+
+var errCookieMalformed = errors.New("cookie value is malformed")
+var errCookieNoMatchingSecret = errors.New("cookie value could not be opened with any configured secret")
+var errCookieBadSignature = errors.New("cookie value signature is invalid")
+
+// cookieCipher seals and opens cookie values with AES-256-GCM so that the credentials are neither readable nor
+// forgeable by the client. The cookie name is bound to the sealed value as additional data so a value sealed for one
+// cookie can't be replayed in another.
+//
+// The payload is additionally signed with an HMAC keyed separately from the cipher, so the timestamps it carries are
+// verified independently of the encryption.
+//
+// Multiple secrets may be configured to allow rotation: the first seals new values and all of them are tried, in
+// order, when opening a value.
+type cookieCipher struct {
+	aeads          []cipher.AEAD
+	signingKeys    [][]byte
+	additionalData []byte
+}
+
+func newCookieCipher(secrets []string, cookieName string) (*cookieCipher, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("creating cookie cipher: no secrets configured")
+	}
+
+	aeads := make([]cipher.AEAD, 0, len(secrets))
+	signingKeys := make([][]byte, 0, len(secrets))
+	for i, secret := range secrets {
+		if secret == "" {
+			return nil, fmt.Errorf("creating cookie cipher: secret %d is empty", i)
+		}
+
+		// Hash the secret so any length secret yields a valid AES-256 key
+		key := sha256.Sum256([]byte(secret))
+
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, fmt.Errorf("creating cookie cipher: %w", err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("creating cookie cipher: %w", err)
+		}
+
+		aeads = append(aeads, aead)
+
+		signingKey := hmac.New(sha256.New, []byte(secret))
+		signingKey.Write([]byte(cookieSigningLabel))
+		signingKeys = append(signingKeys, signingKey.Sum(nil))
+	}
+
+	return &cookieCipher{aeads: aeads, signingKeys: signingKeys, additionalData: []byte(cookieName)}, nil
+}
+
+func (c *cookieCipher) Seal(payload cookiePayload) (string, error) {
+	// Append the signature to the payload so Open can verify it
+	plaintext := payload.marshal()
+	plaintext = append(plaintext, c.sign(0, plaintext)...)
+
+	sealed, err := c.sealBytes(plaintext, c.additionalData)
+	if err != nil {
+		return "", err
+	}
+
+	return cookieValueV3Prefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open returns the payload sealed in value. stale is true when the value should be re-issued, either because it was
+// sealed with a secret other than the current one or because it uses the previous format. Payloads opened from the
+// previous format have no timestamps.
+func (c *cookieCipher) Open(value string) (payload cookiePayload, stale bool, err error) {
+	var encoded string
+	isV3 := false
+	switch {
+	case strings.HasPrefix(value, cookieValueV3Prefix):
+		encoded = strings.TrimPrefix(value, cookieValueV3Prefix)
+		isV3 = true
+	case strings.HasPrefix(value, cookieValueV2Prefix):
+		encoded = strings.TrimPrefix(value, cookieValueV2Prefix)
+	default:
+		return cookiePayload{}, false, errCookieMalformed
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cookiePayload{}, false, errCookieMalformed
+	}
+
+	plaintext, secretIndex, err := c.openBytes(sealed, c.additionalData)
+	if err != nil {
+		return cookiePayload{}, false, err
+	}
+
+	if !isV3 {
+		return cookiePayload{Value: string(plaintext)}, true, nil
+	}
+
+	if len(plaintext) < sha256.Size {
+		return cookiePayload{}, false, errCookieMalformed
+	}
+
+	signed, signature := plaintext[:len(plaintext)-sha256.Size], plaintext[len(plaintext)-sha256.Size:]
+	if !hmac.Equal(signature, c.sign(secretIndex, signed)) {
+		return cookiePayload{}, false, errCookieBadSignature
+	}
+
+	payload, err = unmarshalCookiePayload(signed)
+	if err != nil {
+		return cookiePayload{}, false, err
+	}
+
+	return payload, secretIndex != 0, nil
+}
+
+// sealBytes encrypts plaintext with the current secret, prepending the nonce to the result.
+func (c *cookieCipher) sealBytes(plaintext, additionalData []byte) ([]byte, error) {
+	aead := c.aeads[0]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// openBytes decrypts a result of sealBytes, trying each secret in order. It returns the plaintext and the index of
+// the secret that opened it.
+func (c *cookieCipher) openBytes(sealed, additionalData []byte) ([]byte, int, error) {
+	for i, aead := range c.aeads {
+		nonceSize := aead.NonceSize()
+		if len(sealed) < nonceSize+aead.Overhead() {
+			return nil, 0, errCookieMalformed
+		}
+
+		plaintext, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData)
+		if err != nil {
+			continue
+		}
+
+		return plaintext, i, nil
+	}
+
+	return nil, 0, errCookieNoMatchingSecret
+}
+
+func (c *cookieCipher) sign(secretIndex int, b []byte) []byte {
+	mac := hmac.New(sha256.New, c.signingKeys[secretIndex])
+	mac.Write(b)
+
+	return mac.Sum(nil)
+}
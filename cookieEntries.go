@@ -0,0 +1,158 @@
+package traefik_authhack
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// cookieEntriesValuePrefix marks cookie values that hold an entry per scope
+const cookieEntriesValuePrefix = "map."
+
+// cookieEntries maps scopes (a host, optionally followed by a path prefix) to what a single credential cookie would
+// hold for that scope, so that one cookie can hold different credentials for each service sharing its domain.
+type cookieEntries map[string]string
+
+func decodeCookieEntries(value string) (cookieEntries, error) {
+	if !strings.HasPrefix(value, cookieEntriesValuePrefix) {
+		return nil, errors.New("doesn't hold an entry per scope")
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, cookieEntriesValuePrefix))
+	if err != nil {
+		return nil, errCookieMalformed
+	}
+
+	var entries cookieEntries
+	if err := json.Unmarshal(decoded, &entries); err != nil {
+		return nil, errCookieMalformed
+	}
+
+	return entries, nil
+}
+
+func (e cookieEntries) encode() string {
+	// Marshalling a map of strings can't fail
+	encoded, _ := json.Marshal(e)
+
+	return cookieEntriesValuePrefix + base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// with returns a copy of the entries with the scope's entry replaced, or removed if value is empty.
+func (e cookieEntries) with(scope, value string) cookieEntries {
+	result := make(cookieEntries, len(e)+1)
+	for s, v := range e {
+		result[s] = v
+	}
+
+	if value == "" {
+		delete(result, scope)
+	} else {
+		result[scope] = value
+	}
+
+	return result
+}
+
+// cookieScope returns the scope of the cookie entry for requests to the host and path, which is empty unless
+// MultiCredentialCookie is enabled.
+func (p *AuthHackPlugin) cookieScope(host, path string) string {
+	if !p.config.MultiCredentialCookie {
+		return ""
+	}
+
+	var longestPrefix string
+	for _, prefix := range p.config.CredentialPathPrefixes {
+		trimmed := strings.TrimSuffix(prefix, "/")
+		if (path == trimmed || strings.HasPrefix(path, trimmed+"/")) && len(trimmed) > len(longestPrefix) {
+			longestPrefix = trimmed
+		}
+	}
+
+	return requestHost(host) + longestPrefix
+}
+
+// requestHost returns the lowercased host of a request's Host header, without the port.
+func requestHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(host)
+}
+
+// selectCookieEntry returns the payload of the scope's entry, along with every entry. If MultiCredentialCookie isn't
+// enabled, the payload is returned as-is with nil entries.
+func (p *AuthHackPlugin) selectCookieEntry(payload cookiePayload, scope string) (cookiePayload, cookieEntries) {
+	if !p.config.MultiCredentialCookie {
+		return payload, nil
+	}
+
+	if payload.IsEmpty() {
+		return payload, cookieEntries{}
+	}
+
+	entries, err := decodeCookieEntries(payload.Value)
+	if err != nil {
+		p.log(Info, "rejecting cookie ('%s'): %v", p.config.CookieName, err)
+
+		return cookiePayload{}, cookieEntries{}
+	}
+
+	// The entries share the cookie's timestamps
+	return cookiePayload{Value: entries[scope], IssuedAt: payload.IssuedAt, LastSeen: payload.LastSeen}, entries
+}
+
+// withCookieEntry returns the payload of the whole cookie with the scope's entry replaced by payload. If entries is nil
+// (MultiCredentialCookie isn't enabled), payload is returned as-is.
+func (p *AuthHackPlugin) withCookieEntry(payload cookiePayload, entries cookieEntries, scope string) cookiePayload {
+	if entries == nil {
+		return payload
+	}
+
+	return cookiePayload{Value: entries.with(scope, payload.Value).encode(), IssuedAt: payload.IssuedAt, LastSeen: payload.LastSeen}
+}
+
+// cookieEntryPayloads returns the payload of every entry in the cookie, or just the payload if MultiCredentialCookie
+// isn't enabled.
+func (p *AuthHackPlugin) cookieEntryPayloads(payload cookiePayload) []cookiePayload {
+	if !p.config.MultiCredentialCookie || payload.IsEmpty() {
+		return []cookiePayload{payload}
+	}
+
+	entries, err := decodeCookieEntries(payload.Value)
+	if err != nil {
+		return nil
+	}
+
+	payloads := make([]cookiePayload, 0, len(entries))
+	for _, value := range entries {
+		payloads = append(payloads, cookiePayload{Value: value, IssuedAt: payload.IssuedAt, LastSeen: payload.LastSeen})
+	}
+
+	return payloads
+}
+
+// expireCookieEntry has the client discard the scope's entry, replacing any auth cookie already set on the response.
+// The whole cookie is discarded if no other entries remain or MultiCredentialCookie isn't enabled.
+func (p *AuthHackPlugin) expireCookieEntry(responseWriter http.ResponseWriter, payload cookiePayload, entries cookieEntries, scope string) {
+	remaining := entries.with(scope, "")
+	if entries == nil || len(remaining) == 0 {
+		p.clearAuthCookie(responseWriter)
+
+		return
+	}
+
+	p.removeAuthSetCookies(responseWriter)
+
+	payload.Value = remaining.encode()
+
+	if err := p.setAuthCookie(responseWriter, payload); err != nil {
+		p.log(Warning, "encountered error re-issuing cookie: %v", err)
+
+		p.clearAuthCookie(responseWriter)
+	}
+}
@@ -0,0 +1,61 @@
+package traefik_authhack
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cookiePayload is the content of an auth cookie. The timestamps are only tracked when the cookie is encrypted, since
+// otherwise the client could trivially rewrite them.
+type cookiePayload struct {
+	// Value is either the encoded auth or, when sessions are enabled, a reference to the session holding the auth
+	Value string
+
+	// IssuedAt is when the credentials were first provided, it is carried over when the cookie is renewed
+	IssuedAt time.Time
+	// LastSeen is when the cookie was last issued or renewed
+	LastSeen time.Time
+}
+
+func newCookiePayload(value string, now time.Time) cookiePayload {
+	return cookiePayload{Value: value, IssuedAt: now, LastSeen: now}
+}
+
+// HasTimestamps returns false for payloads read from cookies sealed with the previous format.
+func (c cookiePayload) HasTimestamps() bool {
+	return !c.IssuedAt.IsZero() && !c.LastSeen.IsZero()
+}
+
+func (c cookiePayload) IsEmpty() bool {
+	return c.Value == ""
+}
+
+// marshal encodes the payload as '<issued at>.<last seen>.<value>', with the timestamps in Unix seconds. The value is
+// last so that it may itself contain the separator.
+func (c cookiePayload) marshal() []byte {
+	return []byte(strconv.FormatInt(c.IssuedAt.Unix(), 10) + "." + strconv.FormatInt(c.LastSeen.Unix(), 10) + "." + c.Value)
+}
+
+func unmarshalCookiePayload(b []byte) (cookiePayload, error) {
+	parts := strings.SplitN(string(b), ".", 3)
+	if len(parts) != 3 {
+		return cookiePayload{}, errCookieMalformed
+	}
+
+	issuedAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return cookiePayload{}, errCookieMalformed
+	}
+
+	lastSeen, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return cookiePayload{}, errCookieMalformed
+	}
+
+	return cookiePayload{
+		Value:    parts[2],
+		IssuedAt: time.Unix(issuedAt, 0),
+		LastSeen: time.Unix(lastSeen, 0),
+	}, nil
+}
@@ -5,7 +5,12 @@ import (
 	"strings"
 )
 
+// encodedAuthWithoutPrefix is an Authorization header value with the Basic scheme omitted, so Basic credentials are
+// just the encoded username and password. Credentials for other schemes (e.g. 'Bearer <token>') keep their scheme,
+// exactly as provided.
 type encodedAuthWithoutPrefix string
+
+// encodedAuthWithPrefix is a complete Authorization header value, including the scheme.
 type encodedAuthWithPrefix string
 
 const emptyEncodedAuthWithoutPrefix = (encodedAuthWithoutPrefix)("")
@@ -13,8 +18,13 @@ const emptyEncodedAuthWithoutPrefix = (encodedAuthWithoutPrefix)("")
 //goland:noinspection GoUnusedConst
 const emptyEncodedAuthWithPrefix = (encodedAuthWithPrefix)("")
 
-const basicPrefix = "Basic "
+const basicScheme = "Basic"
+const basicPrefix = basicScheme + " "
+
+const bearerScheme = "Bearer"
+const bearerPrefix = bearerScheme + " "
 
+// newEncodedAuthWithoutPrefix strips any Basic prefixes from encodedAuth, other schemes are kept as-is.
 func newEncodedAuthWithoutPrefix(encodedAuth string) encodedAuthWithoutPrefix {
 	for t := strings.TrimPrefix(encodedAuth, basicPrefix); t != encodedAuth; t = strings.TrimPrefix(encodedAuth, basicPrefix) {
 		encodedAuth = t
@@ -27,9 +37,28 @@ func encodeAuthWithoutPrefix(username, password string) encodedAuthWithoutPrefix
 }
 
 func (a encodedAuthWithoutPrefix) WithPrefix() encodedAuthWithPrefix {
+	if a.hasScheme() {
+		return (encodedAuthWithPrefix)(a)
+	}
+
 	return (encodedAuthWithPrefix)(basicPrefix + a)
 }
 
+// Scheme returns the authentication scheme, which is Basic unless another was provided.
+func (a encodedAuthWithoutPrefix) Scheme() string {
+	if i := strings.IndexByte(a.String(), ' '); i >= 0 {
+		return a.String()[:i]
+	}
+
+	return basicScheme
+}
+
+// hasScheme returns whether the auth carries its own scheme. Basic credentials never contain a space since they're
+// base64 encoded, so a space can only separate a scheme from its credentials.
+func (a encodedAuthWithoutPrefix) hasScheme() bool {
+	return strings.IndexByte(a.String(), ' ') >= 0
+}
+
 func (a encodedAuthWithoutPrefix) String() string {
 	return (string)(a)
 }
@@ -38,6 +67,26 @@ func (a encodedAuthWithoutPrefix) IsEmpty() bool {
 	return a == ""
 }
 
+// Decode returns the username and password, ok is false if the auth isn't valid Basic credentials.
+func (a encodedAuthWithoutPrefix) Decode() (username, password string, ok bool) {
+	credentials := a.String()
+	if a.hasScheme() {
+		// Schemes are case-insensitive, so this may be e.g. 'basic <credentials>'
+		if !strings.EqualFold(a.Scheme(), basicScheme) {
+			return "", "", false
+		}
+
+		credentials = strings.TrimSpace(credentials[len(a.Scheme()):])
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
+
 //goland:noinspection GoUnusedFunction
 func newEncodedAuthWithPrefix(encodedAuth string) encodedAuthWithPrefix {
 	return newEncodedAuthWithoutPrefix(encodedAuth).WithPrefix()
@@ -0,0 +1,109 @@
+package traefik_authhack
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"time"
+)
+
+// fileWatcher polls a file and passes its contents to apply whenever it changes. Polling (rather than inotify or
+// similar) keeps this portable and usable under Yaegi.
+//
+// A change is detected by the modification time or size changing, and confirmed by a hash of the contents so that
+// touching the file doesn't reapply it. If apply returns an error, the previous contents remain in effect.
+type fileWatcher struct {
+	path  string
+	apply func(contents []byte) error
+	log   func(level LogLevel, format string, args ...any)
+
+	// The state of the file when it was last read. Only accessed from the goroutine running Run (or before it starts).
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+func newFileWatcher(path string, apply func(contents []byte) error, log func(level LogLevel, format string, args ...any)) *fileWatcher {
+	return &fileWatcher{path: path, apply: apply, log: log}
+}
+
+// Load reads and applies the file, returning any error.
+func (w *fileWatcher) Load() error {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return fmt.Errorf("reading '%s': %w", w.path, err)
+	}
+
+	contents, err := os.ReadFile(w.path)
+	if err != nil {
+		return fmt.Errorf("reading '%s': %w", w.path, err)
+	}
+
+	hash := sha256.Sum256(contents)
+
+	if err := w.apply(contents); err != nil {
+		return fmt.Errorf("applying '%s': %w", w.path, err)
+	}
+
+	w.modTime, w.size, w.hash = info.ModTime(), info.Size(), hash
+
+	return nil
+}
+
+// Check reloads the file if it has changed since it was last loaded. It returns whether the file was reloaded.
+func (w *fileWatcher) Check() (bool, error) {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return false, fmt.Errorf("reading '%s': %w", w.path, err)
+	}
+
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return false, nil
+	}
+
+	contents, err := os.ReadFile(w.path)
+	if err != nil {
+		return false, fmt.Errorf("reading '%s': %w", w.path, err)
+	}
+
+	hash := sha256.Sum256(contents)
+	if hash == w.hash {
+		// Touched but not modified
+		w.modTime, w.size = info.ModTime(), info.Size()
+
+		return false, nil
+	}
+
+	if err := w.apply(contents); err != nil {
+		// Remember the broken contents so the error is only reported once per change
+		w.modTime, w.size, w.hash = info.ModTime(), info.Size(), hash
+
+		return false, fmt.Errorf("applying '%s': %w", w.path, err)
+	}
+
+	w.modTime, w.size, w.hash = info.ModTime(), info.Size(), hash
+
+	return true, nil
+}
+
+// Run checks the file every interval until the context is done.
+func (w *fileWatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		reloaded, err := w.Check()
+		if err != nil {
+			w.log(Error, "encountered error reloading file, keeping the previous version: %v", err)
+		} else if reloaded {
+			w.log(Info, "reloaded '%s'", w.path)
+		}
+	}
+}
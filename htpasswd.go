@@ -0,0 +1,207 @@
+package traefik_authhack
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const htpasswdSHA1Prefix = "{SHA}"
+const htpasswdAPR1Prefix = "$apr1$"
+const htpasswdMD5CryptPrefix = "$1$"
+
+// htpasswd is a set of users and password hashes parsed from an htpasswd file. Like Traefik's BasicAuth middleware,
+// it supports bcrypt, SHA1 and MD5 (apr1) hashes. Users may also have a TOTP secret, see parseTOTPSecret, as a third
+// field: 'username:hash:secret'.
+type htpasswd struct {
+	users       map[string]string
+	totpSecrets map[string]totpSecret
+}
+
+func parseHtpasswd(reader io.Reader) (*htpasswd, error) {
+	users := make(map[string]string)
+	totpSecrets := make(map[string]totpSecret)
+
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" || hash == "" {
+			return nil, fmt.Errorf("line %d: expected 'username:hash'", lineNumber)
+		}
+
+		// None of the supported hashes contain ':'
+		hash, totp, hasTOTP := strings.Cut(hash, ":")
+
+		if !isSupportedHtpasswdHash(hash) {
+			return nil, fmt.Errorf("line %d: unsupported hash for user '%s'", lineNumber, username)
+		}
+
+		if hasTOTP {
+			secret, err := parseTOTPSecret(totp)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid TOTP secret for user '%s': %w", lineNumber, username, err)
+			}
+
+			totpSecrets[username] = secret
+		}
+
+		users[username] = hash
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &htpasswd{users: users, totpSecrets: totpSecrets}, nil
+}
+
+// Verify returns whether the password matches the user's hash.
+func (h *htpasswd) Verify(username, password string) bool {
+	hash, ok := h.users[username]
+	if !ok {
+		return false
+	}
+
+	return verifyHtpasswdHash(hash, password)
+}
+
+// TOTPSecret returns the user's TOTP secret, or false if they don't have one.
+func (h *htpasswd) TOTPSecret(username string) (totpSecret, bool) {
+	secret, ok := h.totpSecrets[username]
+
+	return secret, ok
+}
+
+// Fingerprint returns a digest of the user's hash, which changes when their password does, or false if the user
+// doesn't exist.
+func (h *htpasswd) Fingerprint(username string) (string, bool) {
+	hash, ok := h.users[username]
+	if !ok {
+		return "", false
+	}
+
+	sum := sha256.Sum256([]byte(hash))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:16]), true
+}
+
+func isSupportedHtpasswdHash(hash string) bool {
+	return strings.HasPrefix(hash, htpasswdSHA1Prefix) ||
+		strings.HasPrefix(hash, htpasswdAPR1Prefix) ||
+		strings.HasPrefix(hash, htpasswdMD5CryptPrefix) ||
+		isBcryptHash(hash)
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func verifyHtpasswdHash(hash, password string) bool {
+	switch {
+	case isBcryptHash(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, htpasswdSHA1Prefix):
+		sum := sha1.Sum([]byte(password))
+		return constantTimeEqual(hash, htpasswdSHA1Prefix+base64.StdEncoding.EncodeToString(sum[:]))
+	case strings.HasPrefix(hash, htpasswdAPR1Prefix):
+		return constantTimeEqual(hash, md5Crypt(password, hash, htpasswdAPR1Prefix))
+	case strings.HasPrefix(hash, htpasswdMD5CryptPrefix):
+		return constantTimeEqual(hash, md5Crypt(password, hash, htpasswdMD5CryptPrefix))
+	default:
+		return false
+	}
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// md5CryptAlphabet is the alphabet used by crypt(3) to encode hashes
+const md5CryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// md5Crypt implements the MD5-based crypt(3) algorithm used by htpasswd's apr1 hashes (and, with the '$1$' magic,
+// by glibc). The salt is read from hash, which is expected to be formatted as '<magic><salt>$<checksum>'.
+func md5Crypt(password, hash, magic string) string {
+	salt := strings.TrimPrefix(hash, magic)
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alternate := md5.New()
+	alternate.Write([]byte(password + salt + password))
+	alternateSum := alternate.Sum(nil)
+
+	digest := md5.New()
+	digest.Write([]byte(password + magic + salt))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			digest.Write(alternateSum)
+		} else {
+			digest.Write(alternateSum[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			digest.Write([]byte{0})
+		} else {
+			digest.Write([]byte{password[0]})
+		}
+	}
+	sum := digest.Sum(nil)
+
+	// Deliberately slow things down
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write([]byte(password))
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write([]byte(password))
+		}
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write([]byte(password))
+		}
+		sum = round.Sum(nil)
+	}
+
+	var result strings.Builder
+	result.WriteString(magic + salt + "$")
+
+	encode := func(value uint32, n int) {
+		for ; n > 0; n-- {
+			result.WriteByte(md5CryptAlphabet[value&0x3f])
+			value >>= 6
+		}
+	}
+	encode(uint32(sum[0])<<16|uint32(sum[6])<<8|uint32(sum[12]), 4)
+	encode(uint32(sum[1])<<16|uint32(sum[7])<<8|uint32(sum[13]), 4)
+	encode(uint32(sum[2])<<16|uint32(sum[8])<<8|uint32(sum[14]), 4)
+	encode(uint32(sum[3])<<16|uint32(sum[9])<<8|uint32(sum[15]), 4)
+	encode(uint32(sum[4])<<16|uint32(sum[10])<<8|uint32(sum[5]), 4)
+	encode(uint32(sum[11]), 2)
+
+	return result.String()
+}
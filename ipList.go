@@ -0,0 +1,60 @@
+package traefik_authhack
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipList is a list of IP ranges, parsed from IP addresses and CIDRs.
+type ipList []*net.IPNet
+
+func parseIPList(name string, values []string) (ipList, error) {
+	list := make(ipList, 0, len(values))
+
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s entry '%s': expected an IP address or CIDR", name, value)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry '%s': %w", name, value, err)
+		}
+
+		list = append(list, ipNet)
+	}
+
+	return list, nil
+}
+
+// Contains returns whether the IP address is in any of the ranges. Invalid addresses are never contained.
+func (l ipList) Contains(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, ipNet := range l {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
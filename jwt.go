@@ -0,0 +1,256 @@
+package traefik_authhack
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errJWTMalformed = errors.New("token is not a well-formed JWT")
+var errJWTBadSignature = errors.New("token signature is invalid")
+var errJWTNoKey = errors.New("no key is configured for the token")
+
+// jwtClaims are the claims of a validated JWT.
+type jwtClaims map[string]any
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// jwtValidator validates JWTs signed with HS256 using a shared secret, or RS256 or ES256 using public keys. The public
+// keys are replaced when the keys file changes.
+type jwtValidator struct {
+	hmacSecret []byte
+	// keys holds a *jwtKeySet, which is nil if no keys file is configured
+	keys atomic.Value
+
+	// issuer and audience are only checked if set
+	issuer   string
+	audience string
+
+	now func() time.Time
+}
+
+func newJWTValidator(hmacSecret, issuer, audience string, now func() time.Time) *jwtValidator {
+	validator := &jwtValidator{issuer: issuer, audience: audience, now: now}
+
+	if hmacSecret != "" {
+		validator.hmacSecret = []byte(hmacSecret)
+	}
+
+	validator.keys.Store((*jwtKeySet)(nil))
+
+	return validator
+}
+
+func (v *jwtValidator) setKeys(keys *jwtKeySet) {
+	v.keys.Store(keys)
+}
+
+// Validate verifies the token's signature and its exp, nbf, iss and aud claims, returning its claims.
+func (v *jwtValidator) Validate(token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+
+	if err := v.verifySignature(header, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if err := v.validateClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (v *jwtValidator) verifySignature(header jwtHeader, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+
+	switch header.Algorithm {
+	case "HS256":
+		if v.hmacSecret == nil {
+			return errJWTNoKey
+		}
+
+		mac := hmac.New(sha256.New, v.hmacSecret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return errJWTBadSignature
+		}
+
+		return nil
+
+	case "RS256":
+		for _, key := range v.getKeys().RSA(header.KeyID) {
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+				return nil
+			}
+		}
+
+		return errJWTBadSignature
+
+	case "ES256":
+		// The signature is the concatenation of the 32 byte r and s values
+		if len(signature) != 64 {
+			return errJWTBadSignature
+		}
+
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+
+		for _, key := range v.getKeys().ECDSA(header.KeyID) {
+			if ecdsa.Verify(key, digest[:], r, s) {
+				return nil
+			}
+		}
+
+		return errJWTBadSignature
+
+	default:
+		// Notably, this rejects 'none'
+		return fmt.Errorf("unsupported token algorithm '%s'", header.Algorithm)
+	}
+}
+
+func (v *jwtValidator) validateClaims(claims jwtClaims) error {
+	now := v.now()
+
+	if exp, ok := claims["exp"]; ok {
+		expiresAt, ok := exp.(float64)
+		if !ok {
+			return errors.New("token 'exp' claim is invalid")
+		}
+
+		if !now.Before(time.Unix(int64(expiresAt), 0)) {
+			return errors.New("token has expired")
+		}
+	}
+
+	if nbf, ok := claims["nbf"]; ok {
+		notBefore, ok := nbf.(float64)
+		if !ok {
+			return errors.New("token 'nbf' claim is invalid")
+		}
+
+		if now.Before(time.Unix(int64(notBefore), 0)) {
+			return errors.New("token isn't valid yet")
+		}
+	}
+
+	if v.issuer != "" {
+		if issuer, _ := claims["iss"].(string); issuer != v.issuer {
+			return fmt.Errorf("token issuer '%v' is invalid", claims["iss"])
+		}
+	}
+
+	if v.audience != "" && !claims.hasAudience(v.audience) {
+		return fmt.Errorf("token audience '%v' is invalid", claims["aud"])
+	}
+
+	return nil
+}
+
+func (v *jwtValidator) getKeys() *jwtKeySet {
+	return v.keys.Load().(*jwtKeySet)
+}
+
+// hasAudience returns whether the aud claim, which may be a string or an array of strings, contains audience.
+func (c jwtClaims) hasAudience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// headerValue returns the claim formatted as a header value. Arrays are joined by commas and objects are JSON encoded.
+func (c jwtClaims) headerValue(name string) (string, bool) {
+	claim, ok := c[name]
+	if !ok || claim == nil {
+		return "", false
+	}
+
+	switch value := claim.(type) {
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if formatted, ok := formatJWTClaimValue(v); ok {
+				values = append(values, formatted)
+			}
+		}
+
+		return strings.Join(values, ","), true
+	default:
+		return formatJWTClaimValue(value)
+	}
+}
+
+func formatJWTClaimValue(value any) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		// Avoid exponents for e.g. timestamps
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case nil:
+		return "", false
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+
+		return string(encoded), true
+	}
+}
+
+func decodeJWTSegment(segment string, v any) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errJWTMalformed
+	}
+
+	if err := json.Unmarshal(decoded, v); err != nil {
+		return errJWTMalformed
+	}
+
+	return nil
+}
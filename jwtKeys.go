@@ -0,0 +1,204 @@
+package traefik_authhack
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// jwtKeySet is a set of public keys for verifying JWTs, parsed from a JWKS or PEM file.
+type jwtKeySet struct {
+	rsaKeys   []jwtKey[*rsa.PublicKey]
+	ecdsaKeys []jwtKey[*ecdsa.PublicKey]
+}
+
+type jwtKey[T any] struct {
+	// id is only available for keys from a JWKS
+	id  string
+	key T
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+// parseJWTKeySet parses either a JWKS (JSON) or one or more PEM encoded public keys or certificates.
+func parseJWTKeySet(contents []byte) (*jwtKeySet, error) {
+	var keys *jwtKeySet
+	var err error
+
+	if trimmed := bytes.TrimSpace(contents); len(trimmed) > 0 && trimmed[0] == '{' {
+		keys, err = parseJWKS(trimmed)
+	} else {
+		keys, err = parsePEMKeys(contents)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys.rsaKeys) == 0 && len(keys.ecdsaKeys) == 0 {
+		return nil, errors.New("no supported keys found")
+	}
+
+	return keys, nil
+}
+
+func parseJWKS(contents []byte) (*jwtKeySet, error) {
+	var set jwks
+	if err := json.Unmarshal(contents, &set); err != nil {
+		return nil, fmt.Errorf("parsing JWKS: %w", err)
+	}
+
+	keys := &jwtKeySet{}
+
+	for i, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		switch key.KeyType {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(key.N)
+			if err != nil {
+				return nil, fmt.Errorf("parsing JWKS key %d: invalid 'n': %w", i, err)
+			}
+
+			e, err := base64.RawURLEncoding.DecodeString(key.E)
+			if err != nil {
+				return nil, fmt.Errorf("parsing JWKS key %d: invalid 'e': %w", i, err)
+			}
+
+			publicKey := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			keys.rsaKeys = append(keys.rsaKeys, jwtKey[*rsa.PublicKey]{id: key.KeyID, key: publicKey})
+
+		case "EC":
+			if key.Curve != "P-256" {
+				// Only ES256 is supported
+				continue
+			}
+
+			x, err := base64.RawURLEncoding.DecodeString(key.X)
+			if err != nil {
+				return nil, fmt.Errorf("parsing JWKS key %d: invalid 'x': %w", i, err)
+			}
+
+			y, err := base64.RawURLEncoding.DecodeString(key.Y)
+			if err != nil {
+				return nil, fmt.Errorf("parsing JWKS key %d: invalid 'y': %w", i, err)
+			}
+
+			publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+				return nil, fmt.Errorf("parsing JWKS key %d: point isn't on the curve", i)
+			}
+
+			keys.ecdsaKeys = append(keys.ecdsaKeys, jwtKey[*ecdsa.PublicKey]{id: key.KeyID, key: publicKey})
+		}
+	}
+
+	return keys, nil
+}
+
+func parsePEMKeys(contents []byte) (*jwtKeySet, error) {
+	keys := &jwtKeySet{}
+
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			break
+		}
+
+		var publicKey any
+		var err error
+
+		switch block.Type {
+		case "PUBLIC KEY":
+			publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			publicKey, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var certificate *x509.Certificate
+			certificate, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				publicKey = certificate.PublicKey
+			}
+		default:
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("parsing PEM '%s': %w", block.Type, err)
+		}
+
+		switch key := publicKey.(type) {
+		case *rsa.PublicKey:
+			keys.rsaKeys = append(keys.rsaKeys, jwtKey[*rsa.PublicKey]{key: key})
+		case *ecdsa.PublicKey:
+			if key.Curve == elliptic.P256() {
+				keys.ecdsaKeys = append(keys.ecdsaKeys, jwtKey[*ecdsa.PublicKey]{key: key})
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// RSA returns the RSA keys to try for a token with the key ID. If a key has the ID, only it is returned.
+func (s *jwtKeySet) RSA(keyID string) []*rsa.PublicKey {
+	if s == nil {
+		return nil
+	}
+
+	return selectJWTKeys(s.rsaKeys, keyID)
+}
+
+// ECDSA returns the ECDSA keys to try for a token with the key ID. If a key has the ID, only it is returned.
+func (s *jwtKeySet) ECDSA(keyID string) []*ecdsa.PublicKey {
+	if s == nil {
+		return nil
+	}
+
+	return selectJWTKeys(s.ecdsaKeys, keyID)
+}
+
+func selectJWTKeys[T any](keys []jwtKey[T], keyID string) []T {
+	if keyID != "" {
+		for _, key := range keys {
+			if key.id == keyID {
+				return []T{key.key}
+			}
+		}
+	}
+
+	result := make([]T, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, key.key)
+	}
+
+	return result
+}
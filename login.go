@@ -0,0 +1,295 @@
+package traefik_authhack
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// loginReturnToParam is the query param and form field holding the URL to return to after logging in
+const loginReturnToParam = "return_to"
+
+// loginCSRFField is the form field holding the CSRF token, which must match the CSRF cookie
+const loginCSRFField = "csrf_token"
+
+const loginUsernameField = "username"
+const loginPasswordField = "password"
+const loginOtpField = "otp"
+
+// loginMaxFormSize limits the size of login form submissions
+const loginMaxFormSize = 64 << 10
+
+// loginCSRFCookieMaxAge is how long (in seconds) the login form can be left open before it has to be reloaded
+const loginCSRFCookieMaxAge = 60 * 60
+
+// defaultLoginTemplate is used when no LoginTemplateFile is configured.
+const defaultLoginTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Realm}} - Log In</title>
+<style>
+body { font-family: sans-serif; display: flex; justify-content: center; margin-top: 10vh; }
+form { display: flex; flex-direction: column; gap: 0.5em; width: 18em; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<form method="post" action="{{.Action}}">
+<h1>{{.Realm}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<input type="hidden" name="{{.CSRFField}}" value="{{.CSRFToken}}">
+<input type="hidden" name="{{.ReturnToField}}" value="{{.ReturnTo}}">
+<label>Username <input type="text" name="{{.UsernameField}}" autocomplete="username" required autofocus></label>
+<label>Password <input type="password" name="{{.PasswordField}}" autocomplete="current-password"></label>
+{{if .OtpField}}<label>Code <input type="text" name="{{.OtpField}}" autocomplete="one-time-code" inputmode="numeric" pattern="[0-9]*" placeholder="If enabled for your account"></label>{{end}}
+<button type="submit">Log In</button>
+</form>
+</body>
+</html>
+`
+
+// loginPageData is passed to the login template.
+type loginPageData struct {
+	Realm     string
+	Action    string
+	CSRFToken string
+	ReturnTo  string
+	Error     string
+
+	CSRFField     string
+	ReturnToField string
+	UsernameField string
+	PasswordField string
+	// OtpField is empty unless TOTP codes are enabled, see OtpQueryParam
+	OtpField string
+}
+
+func parseLoginTemplate(contents string) (*template.Template, error) {
+	return template.New("login").Parse(contents)
+}
+
+// serveLogin serves the login page on GET and handles the form on POST, setting the auth cookie and redirecting to the
+// return URL once the credentials are accepted.
+func (p *AuthHackPlugin) serveLogin(responseWriter http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead:
+		p.renderLogin(responseWriter, http.StatusOK, p.safeReturnTo(request.URL.Query().Get(loginReturnToParam)), "")
+
+	case http.MethodPost:
+		request.Body = http.MaxBytesReader(responseWriter, request.Body, loginMaxFormSize)
+		if err := request.ParseForm(); err != nil {
+			p.log(Info, "rejecting login: %v", err)
+
+			http.Error(responseWriter, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+
+			return
+		}
+
+		returnTo := p.safeReturnTo(request.PostForm.Get(loginReturnToParam))
+
+		csrfCookie, err := request.Cookie(p.loginCSRFCookieName())
+		if err != nil || csrfCookie.Value == "" || !constantTimeEqual(csrfCookie.Value, request.PostForm.Get(loginCSRFField)) {
+			p.log(Info, "rejecting login: CSRF token is missing or doesn't match")
+
+			p.renderLogin(responseWriter, http.StatusForbidden, returnTo, "Your session expired, please try again.")
+
+			return
+		}
+
+		username := request.PostForm.Get(loginUsernameField)
+		auth := encodeAuthWithoutPrefix(username, request.PostForm.Get(loginPasswordField))
+
+		if wait := p.rateLimitWait(request, auth, true); wait > 0 {
+			p.log(Info, "rejecting login: client or user has made too many attempts")
+
+			p.setRetryAfter(responseWriter, wait)
+			p.renderLogin(responseWriter, http.StatusTooManyRequests, returnTo, "Too many attempts, please try again later.")
+
+			return
+		}
+
+		if username == "" || !p.verifyAuth(auth) || !p.verifyOtp(auth, request.PostForm.Get(loginOtpField)) {
+			p.log(Info, "rejecting login: invalid credentials or TOTP code")
+
+			message := "Invalid username or password."
+			if p.totpVerifier != nil {
+				// Don't reveal whether the password was correct
+				message = "Invalid username, password or code."
+			}
+
+			p.recordAuthFailure(request, auth)
+			p.renderLogin(responseWriter, http.StatusUnauthorized, returnTo, message)
+
+			return
+		}
+
+		p.recordAuthSuccess(request, auth)
+
+		// The credentials are for the service being returned to, which has its own entry if the cookie holds one per
+		// service
+		var previous cookiePayload
+		if cookie, err := request.Cookie(p.config.CookieName); err == nil {
+			previous, _ = p.decodeCookieValue(cookie.Value)
+		}
+
+		scope := p.cookieScope(request.Host, returnToPath(returnTo))
+		previous, entries := p.selectCookieEntry(previous, scope)
+
+		cookieValue, err := p.newCookieValue(auth, p.sessionClient(request))
+		if err == nil {
+			err = p.setAuthCookie(responseWriter, p.withCookieEntry(newCookiePayload(cookieValue, p.now()), entries, scope))
+		}
+
+		if err != nil {
+			p.log(Error, "encountered error encoding cookie: %v", err)
+
+			http.Error(responseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+			return
+		}
+
+		// The previous session, if any, is replaced by the new one
+		p.deleteCookieSession(previous)
+
+		p.setLoginCSRFCookie(responseWriter, "", -1)
+
+		p.log(Debug, "login succeeded, redirecting to '%s'", returnTo)
+
+		// HTTP 303 (See Other) has the client GET the original URL rather than re-submitting the form to it
+		http.Redirect(responseWriter, request, returnTo, http.StatusSeeOther)
+
+	default:
+		responseWriter.Header().Set("Allow", "GET, HEAD, POST")
+
+		http.Error(responseWriter, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// renderLogin renders the login page with a new CSRF token.
+func (p *AuthHackPlugin) renderLogin(responseWriter http.ResponseWriter, statusCode int, returnTo, message string) {
+	csrfToken, err := newLoginCSRFToken()
+	if err != nil {
+		p.log(Error, "encountered error generating CSRF token: %v", err)
+
+		http.Error(responseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+		return
+	}
+
+	p.setLoginCSRFCookie(responseWriter, csrfToken, loginCSRFCookieMaxAge)
+
+	responseWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
+	responseWriter.Header().Set("Cache-Control", "no-store")
+	responseWriter.WriteHeader(statusCode)
+
+	var otpField string
+	if p.totpVerifier != nil {
+		otpField = loginOtpField
+	}
+
+	err = p.getLoginTemplate().Execute(responseWriter, loginPageData{
+		Realm:     p.config.Realm,
+		Action:    p.config.LoginPath,
+		CSRFToken: csrfToken,
+		ReturnTo:  returnTo,
+		Error:     message,
+
+		CSRFField:     loginCSRFField,
+		ReturnToField: loginReturnToParam,
+		UsernameField: loginUsernameField,
+		PasswordField: loginPasswordField,
+		OtpField:      otpField,
+	})
+	if err != nil {
+		p.log(Warning, "encountered error rendering login page: %v", err)
+	}
+}
+
+// redirectToLogin redirects the client to the login page, returning to the requested URL afterwards.
+func (p *AuthHackPlugin) redirectToLogin(responseWriter http.ResponseWriter, request *http.Request) {
+	http.Redirect(responseWriter, request, p.loginLocation(request.URL.RequestURI()), http.StatusFound)
+}
+
+// loginLocation returns the URL of the login page, returning to returnTo afterwards.
+func (p *AuthHackPlugin) loginLocation(returnTo string) string {
+	return p.config.LoginPath + "?" + url.Values{loginReturnToParam: {returnTo}}.Encode()
+}
+
+// wantsLogin returns whether a request without credentials should be redirected to the login page. Only page loads are
+// redirected, since other requests, such as fetches and assets, can't use a form.
+func (p *AuthHackPlugin) wantsLogin(request *http.Request) bool {
+	if p.config.LoginPath == "" || (request.Method != http.MethodGet && request.Method != http.MethodHead) {
+		return false
+	}
+
+	// Browsers that send Sec-Fetch-Mode mark page loads as navigations, otherwise fall back to what the client accepts
+	if mode := request.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+
+	return strings.Contains(request.Header.Get("Accept"), "text/html")
+}
+
+// safeReturnTo returns returnTo if it's a path on this host, otherwise '/', so the login page can't be used to
+// redirect clients to another site.
+func (p *AuthHackPlugin) safeReturnTo(returnTo string) string {
+	// Browsers treat '\' like '/', so '/\example.com' would be protocol-relative
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.Contains(returnTo, "\\") {
+		return "/"
+	}
+
+	parsed, err := url.Parse(returnTo)
+	if err != nil || parsed.Scheme != "" || parsed.Host != "" || parsed.Path == p.config.LoginPath {
+		return "/"
+	}
+
+	return returnTo
+}
+
+// returnToPath returns the path of a URL accepted by safeReturnTo.
+func returnToPath(returnTo string) string {
+	parsed, err := url.Parse(returnTo)
+	if err != nil {
+		return "/"
+	}
+
+	return parsed.Path
+}
+
+func (p *AuthHackPlugin) loginCSRFCookieName() string {
+	return p.config.CookieName + "-csrf"
+}
+
+func (p *AuthHackPlugin) setLoginCSRFCookie(responseWriter http.ResponseWriter, value string, maxAge int) {
+	cookie := &http.Cookie{
+		Name:     p.loginCSRFCookieName(),
+		Value:    value,
+		Domain:   p.config.CookieDomain,
+		Path:     p.config.LoginPath,
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	responseWriter.Header().Add("Set-Cookie", cookie.String())
+}
+
+func (p *AuthHackPlugin) getLoginTemplate() *template.Template {
+	return p.loginTemplate.Load().(*template.Template)
+}
+
+func newLoginCSRFToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, token); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
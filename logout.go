@@ -0,0 +1,82 @@
+package traefik_authhack
+
+import (
+	"net/http"
+	"strings"
+)
+
+// logoutAllParam is the query param that, when set to '1', revokes every session of the user rather than just the
+// current one
+const logoutAllParam = "all"
+
+// serveLogout expires the auth cookie, deletes its session and redirects to the configured URL.
+func (p *AuthHackPlugin) serveLogout(responseWriter http.ResponseWriter, request *http.Request) {
+	if cookie, err := request.Cookie(p.config.CookieName); err == nil {
+		payload, _ := p.decodeCookieValue(cookie.Value)
+
+		// Logging out covers every service the cookie holds credentials for
+		for _, entryPayload := range p.cookieEntryPayloads(payload) {
+			if request.URL.Query().Get(logoutAllParam) == "1" {
+				p.revokeAllSessions(entryPayload)
+			}
+
+			p.deleteCookieSession(entryPayload)
+		}
+	}
+
+	p.clearAuthCookie(responseWriter)
+
+	p.log(Debug, "logged out, redirecting to '%s'", p.config.LogoutRedirectURL)
+
+	responseWriter.Header().Set("Cache-Control", "no-store")
+
+	// HTTP 303 (See Other) has the client GET the redirect URL, even if the logout was a form submission
+	http.Redirect(responseWriter, request, p.config.LogoutRedirectURL, http.StatusSeeOther)
+}
+
+// revokeAllSessions deletes every session and revokes every issued token of the user the cookie belongs to.
+func (p *AuthHackPlugin) revokeAllSessions(payload cookiePayload) {
+	switch {
+	case p.sessionTokens != nil && strings.HasPrefix(payload.Value, sessionTokenCookieValuePrefix):
+		claims, err := p.sessionTokens.Verify(strings.TrimPrefix(payload.Value, sessionTokenCookieValuePrefix))
+		if err != nil {
+			p.log(Info, "not revoking tokens: %v", err)
+
+			return
+		}
+
+		username, _ := claims["sub"].(string)
+		p.sessionTokens.RevokeUser(username)
+
+		p.log(Info, "revoked all tokens of user '%s'", username)
+
+	case p.sessions != nil:
+		auth, _ := p.resolveCookieAuth(payload)
+		if auth.IsEmpty() {
+			return
+		}
+
+		deleted := p.sessions.DeleteFunc(func(record sessionRecord) bool {
+			return isSameUser(auth, record.Auth)
+		})
+
+		p.log(Info, "revoked %d sessions", deleted)
+
+	default:
+		// Without sessions or tokens, every cookie holds the credentials themselves, so there's nothing to revoke
+		p.log(Info, "not revoking sessions: neither UseSessions nor SessionTokenSecret are enabled")
+	}
+}
+
+// isSameUser returns whether both auths are for the same user. Basic credentials are compared by username, since the
+// password may have changed, and other schemes are compared exactly.
+func isSameUser(a, b encodedAuthWithoutPrefix) bool {
+	aUsername, _, aOK := a.Decode()
+	bUsername, _, bOK := b.Decode()
+
+	if aOK || bOK {
+		return aOK && bOK && aUsername == bUsername
+	}
+
+	return a == b
+}
@@ -0,0 +1,277 @@
+package traefik_authhack
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// oneTimeLinkNonceSize is the number of random bytes that make each one-time link unique
+const oneTimeLinkNonceSize = 16
+
+// oneTimeLinkGonePage is served in place of the request when a one-time link is reused or has expired
+const oneTimeLinkGonePage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Link expired</title>
+<style>
+body { font-family: system-ui, sans-serif; display: flex; justify-content: center; margin-top: 10vh; color: #222; }
+main { max-width: 24rem; padding: 2rem; text-align: center; }
+</style>
+</head>
+<body>
+<main>
+<h1>This link is no longer valid</h1>
+<p>It has already been used or has expired. Please ask for a new one.</p>
+</main>
+</body>
+</html>
+`
+
+var errOneTimeLinkConsumed = errors.New("link has already been used")
+var errOneTimeLedgerUnavailable = errors.New("link could not be recorded as used")
+
+// oneTimeLedger records the one-time links that have been used, until they expire. If a path is set, the ledger is
+// written to it whenever a link is used, so links can't be reused after a restart.
+type oneTimeLedger struct {
+	path string
+	now  func() time.Time
+
+	mutex sync.Mutex
+	// consumed maps the keys of used links to when they expire
+	consumed map[string]time.Time
+}
+
+func newOneTimeLedger(path string, now func() time.Time) *oneTimeLedger {
+	return &oneTimeLedger{path: path, now: now, consumed: make(map[string]time.Time)}
+}
+
+// Load reads the ledger from its file, if it exists. Unlike a session snapshot, a ledger that can't be read is an error,
+// since ignoring it would allow used links to be reused.
+func (l *oneTimeLedger) Load() error {
+	contents, err := os.ReadFile(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return fmt.Errorf("reading one-time link ledger: %w", err)
+	}
+
+	var consumed map[string]int64
+	if err := json.Unmarshal(contents, &consumed); err != nil {
+		return fmt.Errorf("parsing one-time link ledger '%s': %w", l.path, err)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for key, expiresAt := range consumed {
+		l.consumed[key] = time.Unix(expiresAt, 0)
+	}
+
+	l.removeExpired()
+
+	return nil
+}
+
+// Consume marks the link as used, returning false if it already was. Only one of any concurrent calls for the same
+// link returns true. If writing the ledger fails, the link is left unused and the error is returned, since it could
+// otherwise be reused after a restart.
+func (l *oneTimeLedger) Consume(link string, expiresAt time.Time) (bool, error) {
+	// Only a hash of the link is kept, so the ledger can't be used to recover links
+	sum := sha256.Sum256([]byte(link))
+	key := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.removeExpired()
+
+	if _, ok := l.consumed[key]; ok {
+		return false, nil
+	}
+
+	l.consumed[key] = expiresAt
+
+	if l.path == "" {
+		return true, nil
+	}
+
+	if err := l.save(); err != nil {
+		delete(l.consumed, key)
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (l *oneTimeLedger) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return len(l.consumed)
+}
+
+// removeExpired removes links that have expired, since they're rejected regardless. The mutex must be held.
+func (l *oneTimeLedger) removeExpired() {
+	now := l.now()
+
+	for key, expiresAt := range l.consumed {
+		if !now.Before(expiresAt) {
+			delete(l.consumed, key)
+		}
+	}
+}
+
+// save writes the ledger to its file. The mutex must be held.
+func (l *oneTimeLedger) save() error {
+	consumed := make(map[string]int64, len(l.consumed))
+	for key, expiresAt := range l.consumed {
+		consumed[key] = expiresAt.Unix()
+	}
+
+	contents, err := json.Marshal(consumed)
+	if err != nil {
+		return fmt.Errorf("serializing one-time link ledger: %w", err)
+	}
+
+	if err := writeFileAtomically(l.path, contents); err != nil {
+		return fmt.Errorf("writing one-time link ledger: %w", err)
+	}
+
+	return nil
+}
+
+// newOneTimeLink returns a one-time link, '<id>.<expiry>.<nonce>.<signature>', for the ID that expires at the given
+// time.
+func newOneTimeLink(secret, id string, expiresAt time.Time) (string, error) {
+	nonce := make([]byte, oneTimeLinkNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generating nonce: %w", err)
+	}
+
+	return signLink(secret, id, strconv.FormatInt(expiresAt.Unix(), 10), base64.RawURLEncoding.EncodeToString(nonce)), nil
+}
+
+// consumeOneTimeLink returns the credentials a one-time link stands for, marking it as used. errAuthLinkExpired and
+// errOneTimeLinkConsumed are returned for links that are no longer valid, and errOneTimeLedgerUnavailable if the link
+// couldn't be recorded as used.
+func (p *AuthHackPlugin) consumeOneTimeLink(link string) (encodedAuthWithoutPrefix, error) {
+	fields, err := p.verifyLink(link, 3)
+	if err != nil {
+		return "", err
+	}
+
+	auth, expiresAt, err := p.resolveLinkCredentials(fields[0], fields[1])
+	if err != nil {
+		return "", err
+	}
+
+	consumed, err := p.oneTimeLedger.Consume(link, expiresAt)
+	if err != nil {
+		p.log(Error, "encountered error saving one-time link ledger: %v", err)
+
+		return "", fmt.Errorf("link '%s': %w", fields[0], errOneTimeLedgerUnavailable)
+	}
+
+	if !consumed {
+		return "", fmt.Errorf("link '%s': %w", fields[0], errOneTimeLinkConsumed)
+	}
+
+	return auth, nil
+}
+
+// getAndScrubOneTimeLinkQueryParam returns the credentials from the one-time link query param, if any. An error is
+// returned if the request must not be served: the link is no longer valid, in which case oneTimeLinkGone should be
+// served, or it couldn't be recorded as used. Unless consume is true, the link is scrubbed without being used up, so
+// that it still works for a client that's allowed to use it.
+func (p *AuthHackPlugin) getAndScrubOneTimeLinkQueryParam(request *http.Request, consume bool) (result encodedAuthWithoutPrefix, rejectErr error) {
+	if p.oneTimeLedger == nil {
+		return result, nil
+	}
+
+	query := newQueryWrapper(request)
+
+	if link := query.Get(p.config.OneTimeLinkQueryParam); link != "" {
+		var auth encodedAuthWithoutPrefix
+		var err error
+
+		if consume {
+			auth, err = p.consumeOneTimeLink(link)
+		} else {
+			err = errors.New("client isn't allowed to use query params")
+		}
+
+		if err != nil {
+			p.log(Info, "rejecting one-time link query param ('%s'): %v", p.config.OneTimeLinkQueryParam, err)
+
+			if isOneTimeLinkGone(err) || errors.Is(err, errOneTimeLedgerUnavailable) {
+				rejectErr = err
+			}
+		} else {
+			result = auth
+
+			p.log(Debug, "found one-time link query param ('%s': '%s'), moving to header", p.config.OneTimeLinkQueryParam, link)
+		}
+
+		query.Del(p.config.OneTimeLinkQueryParam)
+	}
+
+	query.Apply()
+
+	return result, rejectErr
+}
+
+// isOneTimeLinkGone returns whether err is for a one-time link that can no longer be used.
+func isOneTimeLinkGone(err error) bool {
+	return errors.Is(err, errAuthLinkExpired) || errors.Is(err, errOneTimeLinkConsumed)
+}
+
+// oneTimeLinkGone responds with a page explaining that a one-time link can't be used.
+func (p *AuthHackPlugin) oneTimeLinkGone(responseWriter http.ResponseWriter) {
+	responseWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
+	responseWriter.Header().Set("Cache-Control", "no-store")
+	responseWriter.WriteHeader(http.StatusGone)
+
+	if _, err := responseWriter.Write([]byte(oneTimeLinkGonePage)); err != nil {
+		p.log(Warning, "encountered error sending one-time link response: %v", err)
+	}
+}
+
+// createAdminOneTimeLink creates a one-time link to an entry in AuthLinksFile, responding with the value of the
+// one-time link query param. The body is the same as for auth links, see adminAuthLinkRequest.
+func (p *AuthHackPlugin) createAdminOneTimeLink(responseWriter http.ResponseWriter, request *http.Request) {
+	id, expiresAt, ok := p.parseAdminLinkRequest(responseWriter, request)
+	if !ok {
+		return
+	}
+
+	link, err := newOneTimeLink(p.config.AuthLinkSecret, id, expiresAt)
+	if err != nil {
+		p.log(Error, "encountered error creating one-time link: %v", err)
+
+		p.writeAdminError(responseWriter, http.StatusInternalServerError)
+
+		return
+	}
+
+	p.log(Info, "created one-time link for '%s' through the admin API", id)
+
+	p.writeAdminJSON(responseWriter, http.StatusOK, map[string]any{
+		"param":     p.config.OneTimeLinkQueryParam,
+		"onetime":   link,
+		"expiresAt": expiresAt.UTC(),
+	})
+}
@@ -0,0 +1,207 @@
+package traefik_authhack
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// lockoutMaxDoublings caps how many times the lockout duration doubles, so lockouts don't grow without bound
+const lockoutMaxDoublings = 6
+
+type rateLimiterEntry struct {
+	key string
+
+	// tokens is how many attempts can be made right away, as of updatedAt
+	tokens    float64
+	updatedAt time.Time
+
+	// failures is the number of failed attempts since the last successful one
+	failures    int
+	lockedUntil time.Time
+}
+
+// rateLimiter limits attempts to present credentials, per key (a client IP or username). Each key has a token bucket
+// that holds up to burst attempts and gains one every interval, and is locked out after lockoutThreshold consecutive
+// failures, for lockoutDuration doubling with each further failure. Either is disabled by a zero value. It is safe for
+// concurrent use and bounded in size, forgetting the least recently used key.
+type rateLimiter struct {
+	burst            int
+	interval         time.Duration
+	lockoutThreshold int
+	lockoutDuration  time.Duration
+	maxCount         int
+	now              func() time.Time
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	// lru orders entries from most (front) to least (back) recently used
+	lru *list.List
+}
+
+func newRateLimiter(burst int, interval time.Duration, lockoutThreshold int, lockoutDuration time.Duration, maxCount int, now func() time.Time) *rateLimiter {
+	return &rateLimiter{
+		burst:            burst,
+		interval:         interval,
+		lockoutThreshold: lockoutThreshold,
+		lockoutDuration:  lockoutDuration,
+		maxCount:         maxCount,
+		now:              now,
+		entries:          make(map[string]*list.Element),
+		lru:              list.New(),
+	}
+}
+
+// Allow returns how long to wait before an attempt can be made for the keys, which is zero if it can be made now. If
+// takeToken is true and the attempt can be made, it's counted against each key's token bucket; otherwise only lockouts
+// apply.
+func (l *rateLimiter) Allow(takeToken bool, keys ...string) time.Duration {
+	now := l.now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var wait time.Duration
+	entries := make([]*rateLimiterEntry, 0, len(keys))
+
+	for _, key := range keys {
+		entry := l.entry(key, now)
+		entries = append(entries, entry)
+
+		if entry.lockedUntil.After(now) && entry.lockedUntil.Sub(now) > wait {
+			wait = entry.lockedUntil.Sub(now)
+		}
+
+		if takeToken && l.burst > 0 && entry.tokens < 1 {
+			if tokenWait := time.Duration((1 - entry.tokens) * float64(l.interval)); tokenWait > wait {
+				wait = tokenWait
+			}
+		}
+	}
+
+	// Only take tokens once the attempt is allowed, so waiting clients aren't penalized further
+	if wait == 0 && takeToken && l.burst > 0 {
+		for _, entry := range entries {
+			entry.tokens--
+		}
+	}
+
+	return wait
+}
+
+// Fail records a failed attempt for the keys, locking out those that reached lockoutThreshold.
+func (l *rateLimiter) Fail(keys ...string) {
+	now := l.now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, key := range keys {
+		entry := l.entry(key, now)
+		entry.failures++
+
+		if l.lockoutThreshold > 0 && entry.failures >= l.lockoutThreshold {
+			doublings := entry.failures - l.lockoutThreshold
+			if doublings > lockoutMaxDoublings {
+				doublings = lockoutMaxDoublings
+			}
+
+			entry.lockedUntil = now.Add(l.lockoutDuration << doublings)
+		}
+	}
+}
+
+// Succeed records a successful attempt for the keys, forgetting their failures.
+func (l *rateLimiter) Succeed(keys ...string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, key := range keys {
+		if element, ok := l.entries[key]; ok {
+			entry := element.Value.(*rateLimiterEntry)
+			entry.failures = 0
+			entry.lockedUntil = time.Time{}
+		}
+	}
+}
+
+func (l *rateLimiter) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.lru.Len()
+}
+
+// entry returns the key's entry with its tokens refilled as of now, adding it if needed. The mutex must be held.
+func (l *rateLimiter) entry(key string, now time.Time) *rateLimiterEntry {
+	if element, ok := l.entries[key]; ok {
+		l.lru.MoveToFront(element)
+
+		entry := element.Value.(*rateLimiterEntry)
+		if l.burst > 0 && now.After(entry.updatedAt) {
+			entry.tokens = math.Min(float64(l.burst), entry.tokens+float64(now.Sub(entry.updatedAt))/float64(l.interval))
+		}
+		entry.updatedAt = now
+
+		return entry
+	}
+
+	for l.lru.Len() >= l.maxCount {
+		delete(l.entries, l.lru.Remove(l.lru.Back()).(*rateLimiterEntry).key)
+	}
+
+	entry := &rateLimiterEntry{key: key, tokens: float64(l.burst), updatedAt: now}
+	l.entries[key] = l.lru.PushFront(entry)
+
+	return entry
+}
+
+// rateLimiterKeys returns the keys attempts with the credentials from the request's client are limited by: the
+// client's IP and, for Basic credentials, the username.
+func (p *AuthHackPlugin) rateLimiterKeys(request *http.Request, auth encodedAuthWithoutPrefix) []string {
+	keys := []string{"ip:" + p.clientIP(request)}
+
+	if username, _, ok := auth.Decode(); ok {
+		keys = append(keys, "user:"+username)
+	}
+
+	return keys
+}
+
+// rateLimitWait returns how long the request's client has to wait before the credentials can be verified, see
+// rateLimiter.Allow.
+func (p *AuthHackPlugin) rateLimitWait(request *http.Request, auth encodedAuthWithoutPrefix, takeToken bool) time.Duration {
+	if p.rateLimiter == nil {
+		return 0
+	}
+
+	return p.rateLimiter.Allow(takeToken, p.rateLimiterKeys(request, auth)...)
+}
+
+// recordAuthFailure counts a rejection of the credentials from the request's client towards a lockout.
+func (p *AuthHackPlugin) recordAuthFailure(request *http.Request, auth encodedAuthWithoutPrefix) {
+	if p.rateLimiter != nil {
+		p.rateLimiter.Fail(p.rateLimiterKeys(request, auth)...)
+	}
+}
+
+// recordAuthSuccess forgets previous rejections of the credentials from the request's client.
+func (p *AuthHackPlugin) recordAuthSuccess(request *http.Request, auth encodedAuthWithoutPrefix) {
+	if p.rateLimiter != nil {
+		p.rateLimiter.Succeed(p.rateLimiterKeys(request, auth)...)
+	}
+}
+
+// setRetryAfter sets the Retry-After header to the wait, rounded up to whole seconds.
+func (p *AuthHackPlugin) setRetryAfter(responseWriter http.ResponseWriter, wait time.Duration) {
+	responseWriter.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+}
+
+func (p *AuthHackPlugin) tooManyRequests(responseWriter http.ResponseWriter, wait time.Duration) {
+	p.setRetryAfter(responseWriter, wait)
+
+	http.Error(responseWriter, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
@@ -0,0 +1,188 @@
+package traefik_authhack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sessionSnapshotAdditionalData binds sealed snapshots to their purpose so they can't be confused with cookie values
+var sessionSnapshotAdditionalData = []byte("traefik-authhack session snapshot")
+
+var errSessionFileSuperseded = errors.New("session file is now saved by a newer instance")
+
+// sessionFileOwners maps each session file to the persister that saves it. When the dynamic configuration is reloaded,
+// Traefik creates new middleware instances before stopping the old ones, each with their own sessions, so only the
+// most recently created persister may write the file. The mutex also serializes writes.
+var sessionFileOwners = struct {
+	sync.Mutex
+	owners map[string]*sessionPersister
+}{owners: make(map[string]*sessionPersister)}
+
+// sessionPersister periodically saves encrypted snapshots of a session store to a file so that sessions survive a
+// restart.
+type sessionPersister struct {
+	path  string
+	store *sessionStore
+	// cipher returns the current cipher, since the cookie secrets may be reloaded
+	cipher func() *cookieCipher
+	log    func(level LogLevel, format string, args ...any)
+
+	// savedVersion is the store version last saved, used to skip saving unchanged snapshots. It's only accessed from
+	// the goroutine running Run (or before it starts).
+	savedVersion uint64
+}
+
+// newSessionPersister creates a persister for the file, taking over saving it from any other persister. Once this
+// returns, the previous owner won't write the file again, so it can be loaded.
+func newSessionPersister(path string, store *sessionStore, cipher func() *cookieCipher, log func(level LogLevel, format string, args ...any)) *sessionPersister {
+	p := &sessionPersister{path: path, store: store, cipher: cipher, log: log}
+
+	sessionFileOwners.Lock()
+	sessionFileOwners.owners[path] = p
+	sessionFileOwners.Unlock()
+
+	return p
+}
+
+// Load restores sessions from the snapshot file, if it exists. Problems reading the file are logged rather than
+// returned since a missing or corrupt snapshot only means clients have to log in again.
+func (p *sessionPersister) Load() {
+	sealed, err := os.ReadFile(p.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			p.log(Info, "no session snapshot found at '%s'", p.path)
+		} else {
+			p.log(Error, "encountered error reading session snapshot '%s', ignoring: %v", p.path, err)
+		}
+
+		return
+	}
+
+	plaintext, _, err := p.cipher().openBytes(sealed, sessionSnapshotAdditionalData)
+	if err != nil {
+		p.log(Error, "encountered error decrypting session snapshot '%s', ignoring: %v", p.path, err)
+
+		return
+	}
+
+	var records []sessionRecord
+	if err := json.Unmarshal(plaintext, &records); err != nil {
+		p.log(Error, "encountered error parsing session snapshot '%s', ignoring: %v", p.path, err)
+
+		return
+	}
+
+	restored := p.store.Restore(records)
+
+	// Nothing changed since what was loaded from the file
+	_, p.savedVersion = p.store.Snapshot()
+
+	p.log(Info, "restored %d of %d sessions from snapshot '%s'", restored, len(records), p.path)
+}
+
+// Save writes a snapshot of the store to the file if it has changed since the last save. errSessionFileSuperseded is
+// returned once a newer persister has been created for the file.
+func (p *sessionPersister) Save() error {
+	records, version := p.store.Snapshot()
+	if version == p.savedVersion {
+		return nil
+	}
+
+	plaintext, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("serializing session snapshot: %w", err)
+	}
+
+	sealed, err := p.cipher().sealBytes(plaintext, sessionSnapshotAdditionalData)
+	if err != nil {
+		return fmt.Errorf("encrypting session snapshot: %w", err)
+	}
+
+	sessionFileOwners.Lock()
+	defer sessionFileOwners.Unlock()
+
+	if sessionFileOwners.owners[p.path] != p {
+		return errSessionFileSuperseded
+	}
+
+	if err := writeFileAtomically(p.path, sealed); err != nil {
+		return fmt.Errorf("writing session snapshot: %w", err)
+	}
+
+	p.savedVersion = version
+
+	return nil
+}
+
+// writeFileAtomically writes the contents to a temporary file which then replaces the file, so that a crash mid-write
+// can't corrupt it.
+func writeFileAtomically(path string, contents []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = temp.Write(contents)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+
+	if err != nil {
+		_ = os.Remove(temp.Name())
+	}
+
+	return err
+}
+
+// Run saves snapshots every interval until the context is done, saving a final snapshot before returning. It returns
+// early once another persister has taken over the file.
+func (p *sessionPersister) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		done := false
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			done = true
+		}
+
+		if err := p.Save(); errors.Is(err, errSessionFileSuperseded) {
+			p.log(Info, "stopped saving session snapshot '%s': %v", p.path, err)
+
+			return
+		} else if err != nil {
+			p.log(Error, "encountered error saving session snapshot '%s': %v", p.path, err)
+		}
+
+		if done {
+			p.release()
+
+			return
+		}
+	}
+}
+
+// release gives up saving the file, unless another persister has already taken it over.
+func (p *sessionPersister) release() {
+	sessionFileOwners.Lock()
+	defer sessionFileOwners.Unlock()
+
+	if sessionFileOwners.owners[p.path] == p {
+		delete(sessionFileOwners.owners, p.path)
+	}
+}
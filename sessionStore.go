@@ -0,0 +1,239 @@
+package traefik_authhack
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// sessionIDSize is the size of session IDs in bytes (256 bits)
+const sessionIDSize = 32
+
+type session struct {
+	id        string
+	auth      encodedAuthWithoutPrefix
+	client    sessionClient
+	createdAt time.Time
+	lastSeen  time.Time
+	expiresAt time.Time
+}
+
+// sessionClient describes the client a session was created for.
+type sessionClient struct {
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+// sessionStore is an in-memory map of session IDs to auth. It is safe for concurrent use. Sessions expire once they
+// haven't been used for the TTL and, once the store is full, the least recently used session is evicted to make room
+// for a new one.
+type sessionStore struct {
+	ttl      time.Duration
+	maxCount int
+	now      func() time.Time
+
+	mutex sync.Mutex
+	// sessions maps session IDs to their element in lru
+	sessions map[string]*list.Element
+	// lru orders sessions from most (front) to least (back) recently used. Since using a session extends its
+	// expiration, this is also ordered from latest to earliest expiration.
+	lru *list.List
+	// version is incremented on every change so that persistence can skip unchanged snapshots
+	version uint64
+}
+
+// sessionRecord is the serializable form of a session.
+type sessionRecord struct {
+	ID        string                   `json:"id"`
+	Auth      encodedAuthWithoutPrefix `json:"auth"`
+	Client    sessionClient            `json:"client"`
+	CreatedAt time.Time                `json:"createdAt"`
+	LastSeen  time.Time                `json:"lastSeen"`
+	ExpiresAt time.Time                `json:"expiresAt"`
+}
+
+func newSessionStore(ttl time.Duration, maxCount int, now func() time.Time) *sessionStore {
+	return &sessionStore{
+		ttl:      ttl,
+		maxCount: maxCount,
+		now:      now,
+		sessions: make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Create stores the auth in a new session for the client and returns its ID.
+func (s *sessionStore) Create(auth encodedAuthWithoutPrefix, client sessionClient) (string, error) {
+	idBytes := make([]byte, sessionIDSize)
+	if _, err := io.ReadFull(rand.Reader, idBytes); err != nil {
+		return "", fmt.Errorf("generating session ID: %w", err)
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(idBytes)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+
+	s.removeExpired(now)
+
+	for s.lru.Len() >= s.maxCount {
+		s.remove(s.lru.Back())
+	}
+
+	s.sessions[id] = s.lru.PushFront(&session{id: id, auth: auth, client: client, createdAt: now, lastSeen: now, expiresAt: now.Add(s.ttl)})
+	s.version++
+
+	return id, nil
+}
+
+// Get returns the auth for the session and extends its expiration. ok is false if the session doesn't exist or has
+// expired.
+func (s *sessionStore) Get(id string) (auth encodedAuthWithoutPrefix, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	element, ok := s.sessions[id]
+	if !ok {
+		return emptyEncodedAuthWithoutPrefix, false
+	}
+
+	now := s.now()
+
+	session := element.Value.(*session)
+	if !now.Before(session.expiresAt) {
+		s.remove(element)
+
+		return emptyEncodedAuthWithoutPrefix, false
+	}
+
+	session.lastSeen = now
+	session.expiresAt = now.Add(s.ttl)
+	s.lru.MoveToFront(element)
+	s.version++
+
+	return session.auth, true
+}
+
+func (s *sessionStore) Delete(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if element, ok := s.sessions[id]; ok {
+		s.remove(element)
+	}
+}
+
+func (s *sessionStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.lru.Len()
+}
+
+// Snapshot returns the unexpired sessions, from least to most recently used, and the version of the store they were
+// taken at.
+func (s *sessionStore) Snapshot() ([]sessionRecord, uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.removeExpired(s.now())
+
+	records := make([]sessionRecord, 0, s.lru.Len())
+	for element := s.lru.Back(); element != nil; element = element.Prev() {
+		records = append(records, element.Value.(*session).record())
+	}
+
+	return records, s.version
+}
+
+// Restore adds the sessions from a snapshot, skipping any that have expired or already exist. Records are expected
+// from least to most recently used, as returned by Snapshot. It returns the number of sessions restored.
+func (s *sessionStore) Restore(records []sessionRecord) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	restored := 0
+
+	for _, record := range records {
+		if record.ID == "" || !now.Before(record.ExpiresAt) {
+			continue
+		}
+
+		if _, ok := s.sessions[record.ID]; ok {
+			continue
+		}
+
+		for s.lru.Len() >= s.maxCount {
+			s.remove(s.lru.Back())
+		}
+
+		s.sessions[record.ID] = s.lru.PushFront(&session{
+			id:        record.ID,
+			auth:      record.Auth,
+			client:    record.Client,
+			createdAt: record.CreatedAt,
+			lastSeen:  record.LastSeen,
+			expiresAt: record.ExpiresAt,
+		})
+		restored++
+	}
+
+	if restored != 0 {
+		s.version++
+	}
+
+	return restored
+}
+
+// DeleteFunc deletes every session that matches, returning how many were deleted.
+func (s *sessionStore) DeleteFunc(match func(record sessionRecord) bool) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deleted := 0
+
+	for element := s.lru.Front(); element != nil; {
+		next := element.Next()
+
+		if match(element.Value.(*session).record()) {
+			s.remove(element)
+			deleted++
+		}
+
+		element = next
+	}
+
+	return deleted
+}
+
+// removeExpired must be called with the mutex held.
+func (s *sessionStore) removeExpired(now time.Time) {
+	for element := s.lru.Back(); element != nil && !now.Before(element.Value.(*session).expiresAt); element = s.lru.Back() {
+		s.remove(element)
+	}
+}
+
+// remove must be called with the mutex held.
+func (s *sessionStore) remove(element *list.Element) {
+	delete(s.sessions, element.Value.(*session).id)
+	s.lru.Remove(element)
+	s.version++
+}
+
+func (s *session) record() sessionRecord {
+	return sessionRecord{
+		ID:        s.id,
+		Auth:      s.auth,
+		Client:    s.client,
+		CreatedAt: s.createdAt,
+		LastSeen:  s.lastSeen,
+		ExpiresAt: s.expiresAt,
+	}
+}
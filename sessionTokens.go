@@ -0,0 +1,135 @@
+package traefik_authhack
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// sessionTokenCookieValuePrefix marks cookie values that hold a token issued by the plugin
+const sessionTokenCookieValuePrefix = "jwt."
+
+// sessionTokenIssuer is the 'iss' claim of tokens issued by the plugin
+const sessionTokenIssuer = "traefik-authhack"
+
+// sessionTokenFingerprintClaim holds a fingerprint of the user's password hash so that changing the password
+// invalidates issued tokens
+const sessionTokenFingerprintClaim = "fpr"
+
+// sessionTokens issues short-lived HS256 JWTs in exchange for verified Basic credentials, so the cookie identifies the
+// user without holding their password. Tokens are renewed once half of their lifetime has elapsed.
+type sessionTokens struct {
+	secret    []byte
+	lifetime  time.Duration
+	validator *jwtValidator
+	now       func() time.Time
+
+	mutex sync.Mutex
+	// revoked is when each user's tokens were last revoked, tokens issued until then are rejected. It's only kept in
+	// memory, but entries are only needed until the tokens they revoke expire.
+	revoked map[string]time.Time
+}
+
+func newSessionTokens(secret string, lifetime time.Duration, now func() time.Time) *sessionTokens {
+	return &sessionTokens{
+		secret:    []byte(secret),
+		lifetime:  lifetime,
+		validator: newJWTValidator(secret, sessionTokenIssuer, "", now),
+		now:       now,
+		revoked:   make(map[string]time.Time),
+	}
+}
+
+// Issue returns a token for the user with the fingerprint of their password hash.
+func (t *sessionTokens) Issue(username, fingerprint string) (string, error) {
+	now := t.now()
+
+	return signJWT(t.secret, jwtClaims{
+		"iss":                        sessionTokenIssuer,
+		"sub":                        username,
+		"iat":                        now.Unix(),
+		"exp":                        now.Add(t.lifetime).Unix(),
+		sessionTokenFingerprintClaim: fingerprint,
+	})
+}
+
+// Verify validates a token issued by Issue, returning its claims.
+func (t *sessionTokens) Verify(token string) (jwtClaims, error) {
+	claims, err := t.validator.Validate(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := claims["exp"].(float64); !ok {
+		return nil, errors.New("token has no expiry")
+	}
+
+	username, ok := claims["sub"].(string)
+	if !ok {
+		return nil, errors.New("token has no subject")
+	}
+
+	issuedAt, _ := claims["iat"].(float64)
+	if t.isRevoked(username, time.Unix(int64(issuedAt), 0)) {
+		return nil, errors.New("token was revoked")
+	}
+
+	return claims, nil
+}
+
+// RevokeUser rejects every token issued to the user so far.
+func (t *sessionTokens) RevokeUser(username string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+
+	for user, revokedAt := range t.revoked {
+		if now.Sub(revokedAt) > t.lifetime {
+			delete(t.revoked, user)
+		}
+	}
+
+	t.revoked[username] = now
+}
+
+func (t *sessionTokens) isRevoked(username string, issuedAt time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	revokedAt, ok := t.revoked[username]
+
+	// Issued at times are truncated to seconds, so tokens issued in the same second as the revocation are revoked too
+	return ok && !issuedAt.After(revokedAt)
+}
+
+// NeedsRenewal returns whether half of the verified token's lifetime has elapsed.
+func (t *sessionTokens) NeedsRenewal(claims jwtClaims) bool {
+	expiresAt, _ := claims["exp"].(float64)
+
+	return time.Unix(int64(expiresAt), 0).Sub(t.now()) <= t.lifetime/2
+}
+
+// signJWT returns an HS256 JWT with the claims.
+func signJWT(secret []byte, claims jwtClaims) (string, error) {
+	header, err := json.Marshal(jwtHeader{Algorithm: "HS256"})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,128 @@
+package traefik_authhack
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// totpPeriod is how long each TOTP code is valid for, the default of RFC 6238 and authenticator apps
+const totpPeriod = 30 * time.Second
+
+// totpDigits is the length of TOTP codes
+const totpDigits = 6
+
+// totpSecret is a user's TOTP (RFC 6238) secret and the hash it's used with.
+type totpSecret struct {
+	key  []byte
+	hash func() hash.Hash
+}
+
+// parseTOTPSecret parses a base32 secret, as shown by authenticator apps, optionally prefixed by the algorithm
+// ('sha1:' or 'sha256:'). The default algorithm is SHA1.
+func parseTOTPSecret(value string) (totpSecret, error) {
+	secret := totpSecret{hash: sha1.New}
+
+	if algorithm, key, ok := strings.Cut(value, ":"); ok {
+		switch strings.ToLower(algorithm) {
+		case "sha1":
+		case "sha256":
+			secret.hash = sha256.New
+		default:
+			return totpSecret{}, fmt.Errorf("unsupported TOTP algorithm '%s'", algorithm)
+		}
+
+		value = key
+	}
+
+	// Secrets are often shown in groups, padded or in lowercase
+	value = strings.ToUpper(strings.TrimRight(strings.ReplaceAll(value, " ", ""), "="))
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(value)
+	if err != nil || len(key) == 0 {
+		return totpSecret{}, errors.New("TOTP secret isn't valid base32")
+	}
+
+	secret.key = key
+
+	return secret, nil
+}
+
+// Code returns the code for the counter, the number of periods since the Unix epoch.
+func (s totpSecret) Code(counter uint64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+
+	mac := hmac.New(s.hash, s.key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, see RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	code := strconv.FormatUint(uint64(value%1000000), 10)
+
+	return strings.Repeat("0", totpDigits-len(code)) + code
+}
+
+// totpVerifier verifies TOTP codes, accepting codes from up to skew periods before or after the current one. Accepted
+// codes are remembered until they can no longer be accepted, so they can't be replayed.
+type totpVerifier struct {
+	skew int
+	now  func() time.Time
+
+	mutex sync.Mutex
+	// used maps '<username>:<counter>' to when the code can no longer be accepted
+	used map[string]time.Time
+}
+
+func newTOTPVerifier(skew int, now func() time.Time) *totpVerifier {
+	return &totpVerifier{skew: skew, now: now, used: make(map[string]time.Time)}
+}
+
+// Verify returns whether the code is valid for the user's secret and hasn't been used before.
+func (v *totpVerifier) Verify(username string, secret totpSecret, code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+
+	now := v.now()
+	current := now.Unix() / int64(totpPeriod/time.Second)
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	for key, expiresAt := range v.used {
+		if !now.Before(expiresAt) {
+			delete(v.used, key)
+		}
+	}
+
+	for counter := current - int64(v.skew); counter <= current+int64(v.skew); counter++ {
+		if counter < 0 || !constantTimeEqual(secret.Code(uint64(counter)), code) {
+			continue
+		}
+
+		key := username + ":" + strconv.FormatInt(counter, 10)
+		if _, ok := v.used[key]; ok {
+			return false
+		}
+
+		// The code is accepted until the period skew periods after its own ends
+		v.used[key] = time.Unix((counter+int64(v.skew)+1)*int64(totpPeriod/time.Second), 0)
+
+		return true
+	}
+
+	return false
+}
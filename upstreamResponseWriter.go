@@ -0,0 +1,79 @@
+package traefik_authhack
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// upstreamResponseWriter wraps the http.ResponseWriter passed downstream so that 401 (Unauthorized) responses can be
+// handled by the plugin. If onUnauthorized sends its own response, the upstream response's body is discarded.
+type upstreamResponseWriter struct {
+	http.ResponseWriter
+
+	// onUnauthorized is called before the upstream 401 response's header is written and returns whether it sent a
+	// response in its place
+	onUnauthorized func(responseWriter http.ResponseWriter) bool
+
+	wroteHeader bool
+	discard     bool
+}
+
+func newUpstreamResponseWriter(responseWriter http.ResponseWriter, onUnauthorized func(responseWriter http.ResponseWriter) bool) *upstreamResponseWriter {
+	return &upstreamResponseWriter{ResponseWriter: responseWriter, onUnauthorized: onUnauthorized}
+}
+
+func (w *upstreamResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	if statusCode == http.StatusUnauthorized && w.onUnauthorized(w.ResponseWriter) {
+		w.discard = true
+
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *upstreamResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.discard {
+		return len(b), nil
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush supports streaming responses (e.g. server-sent events) through the plugin.
+func (w *upstreamResponseWriter) Flush() {
+	if w.discard {
+		return
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack supports upgraded connections (e.g. WebSockets) through the plugin.
+func (w *upstreamResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer doesn't support hijacking")
+	}
+
+	return hijacker.Hijack()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying http.ResponseWriter.
+func (w *upstreamResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
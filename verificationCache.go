@@ -0,0 +1,144 @@
+package traefik_authhack
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type verificationCacheKey [sha256.Size]byte
+
+type verificationCacheEntry struct {
+	key       verificationCacheKey
+	expiresAt time.Time
+}
+
+// verificationCache remembers credentials that were recently verified so that slow hashes (e.g. bcrypt) don't need to
+// be checked on every request. Credentials are only stored as an HMAC keyed with a random per-cache key, never in
+// plain text. It is safe for concurrent use, bounded in size (evicting the least recently verified entry) and entries
+// expire after a TTL from when they were verified.
+type verificationCache struct {
+	hashKey  []byte
+	ttl      time.Duration
+	maxCount int
+	now      func() time.Time
+
+	mutex   sync.Mutex
+	entries map[verificationCacheKey]*list.Element
+	// lru orders entries from most (front) to least (back) recently verified, which is also latest to earliest
+	// expiration
+	lru *list.List
+	// generation is incremented when the cache is cleared so that verifications that started beforehand aren't added
+	generation uint64
+}
+
+func newVerificationCache(ttl time.Duration, maxCount int, now func() time.Time) (*verificationCache, error) {
+	hashKey := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(rand.Reader, hashKey); err != nil {
+		return nil, fmt.Errorf("generating verification cache key: %w", err)
+	}
+
+	return &verificationCache{
+		hashKey:  hashKey,
+		ttl:      ttl,
+		maxCount: maxCount,
+		now:      now,
+		entries:  make(map[verificationCacheKey]*list.Element),
+		lru:      list.New(),
+	}, nil
+}
+
+// Contains returns whether the credentials were verified within the TTL.
+func (c *verificationCache) Contains(username, password string) bool {
+	key := c.key(username, password)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+
+	if !c.now().Before(element.Value.(*verificationCacheEntry).expiresAt) {
+		c.remove(element)
+
+		return false
+	}
+
+	return true
+}
+
+// Generation returns the current generation, to be passed to Add once verification completes.
+func (c *verificationCache) Generation() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.generation
+}
+
+// Add records that the credentials were verified, unless the cache was cleared since generation was read.
+func (c *verificationCache) Add(username, password string, generation uint64) {
+	key := c.key(username, password)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	expiresAt := c.now().Add(c.ttl)
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*verificationCacheEntry).expiresAt = expiresAt
+		c.lru.MoveToFront(element)
+
+		return
+	}
+
+	for c.lru.Len() >= c.maxCount {
+		c.remove(c.lru.Back())
+	}
+
+	c.entries[key] = c.lru.PushFront(&verificationCacheEntry{key: key, expiresAt: expiresAt})
+}
+
+// Clear removes all entries, e.g. when the users they were verified against change.
+func (c *verificationCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = make(map[verificationCacheKey]*list.Element)
+	c.lru.Init()
+	c.generation++
+}
+
+func (c *verificationCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *verificationCache) key(username, password string) verificationCacheKey {
+	mac := hmac.New(sha256.New, c.hashKey)
+	// Length prefix the username so that the boundary between username and password is unambiguous
+	mac.Write([]byte(fmt.Sprintf("%d:%s:%s", len(username), username, password)))
+
+	var key verificationCacheKey
+	copy(key[:], mac.Sum(nil))
+
+	return key
+}
+
+// remove must be called with the mutex held.
+func (c *verificationCache) remove(element *list.Element) {
+	delete(c.entries, element.Value.(*verificationCacheEntry).key)
+	c.lru.Remove(element)
+}